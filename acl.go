@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Security event counted when gossip carries a value its author may not write
+const SecurityUnauthorized = "unauthorized"
+
+// ACLRule grants read or write rights on the keys under a prefix. Subjects
+// are peer IDs or certificate roles, with "*" matching every peer
+type ACLRule struct {
+	Prefix   string
+	Subjects []string
+	Read     bool
+	Write    bool
+}
+
+// CanRead reports whether a peer may hold the value under Key
+func (c *Cluster) CanRead(PeerID, Key string) bool {
+	return c.checkACL(PeerID, c.PeerRoles, Key, func(r ACLRule) bool { return r.Read })
+}
+
+// CanWrite reports whether a peer may author the value under Key
+func (c *Cluster) CanWrite(PeerID, Key string) bool {
+	return c.checkACL(PeerID, c.PeerRoles, Key, func(r ACLRule) bool { return r.Write })
+}
+
+// canWriteAs is CanWrite for an author whose roles are already known, which
+// may no longer be a peer
+func (c *Cluster) canWriteAs(Author *Peer, Key string) bool {
+	roles := func(string) []string { return Author.Roles }
+	return c.checkACL(Author.ID, roles, Key, func(r ACLRule) bool { return r.Write })
+}
+
+// checkACL applies the rules with the longest prefix matching the key. Keys
+// no rule covers are open to every peer, as is everything without an ACL
+func (c *Cluster) checkACL(PeerID string, Roles func(string) []string, Key string, Grants func(ACLRule) bool) bool {
+	longest := -1
+	for _, rule := range c.ACL {
+		if strings.HasPrefix(Key, rule.Prefix) && len(rule.Prefix) > longest {
+			longest = len(rule.Prefix)
+		}
+	}
+	if longest == -1 {
+		return true
+	}
+	roles := Roles(PeerID)
+	for _, rule := range c.ACL {
+		if len(rule.Prefix) != longest || !strings.HasPrefix(Key, rule.Prefix) || !Grants(rule) {
+			continue
+		}
+		for _, subject := range rule.Subjects {
+			if subject == "*" || subject == PeerID {
+				return true
+			}
+			for _, role := range roles {
+				if subject == role {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// SetValue writes and signs a value as the local peer, which gossip then
+// spreads. Values in an encrypted namespace are encrypted first
+func (c *Cluster) SetValue(Key string, Contents map[string]interface{}, ConflictResolutionMode int) error {
+	if !c.CanWrite(c.LocalPeer.ID, Key) {
+		return errors.New("Not allowed to write " + Key)
+	}
+	value := &Value{Modified: c.Clock.Now().UnixNano(), ConflictResolutionMode: ConflictResolutionMode, Value: Contents}
+	err := c.SealValue(Key, value)
+	if err != nil {
+		return err
+	}
+	err = c.SignValue(Key, value)
+	if err != nil {
+		return err
+	}
+	c.ValuesMutex.Lock()
+	c.Values[Key] = value
+	c.ValuesMutex.Unlock()
+	return nil
+}
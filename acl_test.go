@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestACL(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	ca, caKey := newTestCA(t)
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	now := S.Clock.Now()
+	acl := []ACLRule{
+		{Prefix: "config/", Subjects: []string{"admin"}, Read: true, Write: true},
+		{Prefix: "config/", Subjects: []string{"*"}, Read: true},
+		{Prefix: "secrets/", Subjects: []string{"admin"}, Read: true, Write: true},
+		{Prefix: "config/web/", Subjects: []string{"web", "admin"}, Read: true, Write: true},
+	}
+	roles := [][]string{{"admin"}, {"web"}, {"batch"}}
+	for i, role := range roles {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		cert, err := IssueCertificate(ca, caKey, fmt.Sprintf("node-%06d", i), role, key.Public(), now, now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = S.AddCluster(&Cluster{Suite: Ed25519Suite{}, IdentityKey: key, CA: ca, Certificate: cert, ACL: acl})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	S.Run(time.Second * 5)
+	admin, web, batch := S.Clusters[0], S.Clusters[1], S.Clusters[2]
+
+	if admin.SetValue("config/db", map[string]interface{}{"host": "db1"}, 0) != nil {
+		t.Error(errors.New("Admin should write config"))
+	}
+	admin.SetValue("secrets/db", map[string]interface{}{"password": "hunter2"}, 0)
+	if web.SetValue("config/web/port", map[string]interface{}{"port": 80}, 0) != nil {
+		t.Error(errors.New("Web should write its own config"))
+	}
+	if batch.SetValue("config/db", map[string]interface{}{"host": "evil"}, 0) == nil {
+		t.Error(errors.New("Batch should not write config"))
+	}
+	if batch.SetValue("jobs/1", map[string]interface{}{"state": "done"}, 0) != nil {
+		t.Error(errors.New("Keys without rules should be open"))
+	}
+	S.Run(time.Second * 10)
+	for _, C := range S.Clusters {
+		if C.Values["config/db"] == nil || C.Values["config/db"].Value["host"] != "db1" || C.Values["jobs/1"] == nil {
+			t.Error(errors.New("Permitted values did not spread"))
+		}
+	}
+	//The most specific prefix decides, so only web and admin read web config
+	if admin.Values["config/web/port"] == nil || batch.Values["config/web/port"] != nil {
+		t.Error(errors.New("Web config should only reach its readers"))
+	}
+	if admin.Values["secrets/db"] == nil || web.Values["secrets/db"] != nil || batch.Values["secrets/db"] != nil {
+		t.Error(errors.New("Secrets should only reach readers"))
+	}
+
+	//A compromised node writing behind the ACL's back is ignored by the others
+	batch.ValuesMutex.Lock()
+	batch.Values["config/db"] = &Value{Modified: S.Clock.Now().UnixNano(), Author: batch.LocalPeer.ID, Value: map[string]interface{}{"host": "evil"}}
+	batch.ValuesMutex.Unlock()
+	S.Run(time.Second * 10)
+	if admin.Values["config/db"].Value["host"] != "db1" || web.Values["config/db"].Value["host"] != "db1" {
+		t.Error(errors.New("Unauthorized write was accepted"))
+	}
+	if admin.SecurityEventCounts()[SecurityUnauthorized] == 0 {
+		t.Error(errors.New("Unauthorized write was not counted"))
+	}
+	S.Shutdown()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// IssueCertificate signs a certificate admitting a node to the cluster. The
+// node ID is the common name and its roles are the organizational units
+func IssueCertificate(CA *x509.Certificate, CAKey crypto.Signer, NodeID string, Roles []string, PublicKey crypto.PublicKey, NotBefore, NotAfter time.Time) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: NodeID, OrganizationalUnit: Roles},
+		NotBefore:    NotBefore,
+		NotAfter:     NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	return x509.CreateCertificate(rand.Reader, template, CA, PublicKey, CAKey)
+}
+
+// AdmitPeer checks a peer's certificate when the cluster has a CA, and sets
+// the peer's roles from it. Without a CA every peer is admitted
+func (c *Cluster) AdmitPeer(p *Peer) error {
+	if c.CA == nil {
+		//Roles only come from certificates, never from what a peer claims
+		p.Roles = nil
+		return nil
+	}
+	if len(p.Certificate) == 0 {
+		return errors.New("Peer has no certificate")
+	}
+	cert, err := x509.ParseCertificate(p.Certificate)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(c.CA)
+	//Checks the signature and that the certificate has not expired
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: c.Clock.Now(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return err
+	}
+	if cert.Subject.CommonName != p.ID {
+		return errors.New("Certificate was issued to another node")
+	}
+	//The certificate must vouch for the identity key the peer signs with
+	publicKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(publicKey, p.PublicKey) {
+		return errors.New("Certificate does not match the peer's identity key")
+	}
+	if c.IsRevoked(cert.SerialNumber) {
+		return errors.New("Certificate has been revoked")
+	}
+	p.Roles = cert.Subject.OrganizationalUnit
+	return nil
+}
+
+func (c *Cluster) IsRevoked(Serial *big.Int) bool {
+	c.RevocationMutex.RLock()
+	defer c.RevocationMutex.RUnlock()
+	if c.Revocations == nil {
+		return false
+	}
+	for _, entry := range c.Revocations.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(Serial) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateRevocationList installs a revocation list signed by the cluster CA if
+// it is newer than the current one, then removes any peer it revokes. Gossip
+// carries the list to the rest of the cluster
+func (c *Cluster) UpdateRevocationList(DER []byte) error {
+	if c.CA == nil || len(DER) == 0 {
+		return nil
+	}
+	list, err := x509.ParseRevocationList(DER)
+	if err != nil {
+		return err
+	}
+	err = list.CheckSignatureFrom(c.CA)
+	if err != nil {
+		return err
+	}
+	c.RevocationMutex.Lock()
+	if c.Revocations != nil && list.Number.Cmp(c.Revocations.Number) <= 0 {
+		c.RevocationMutex.Unlock()
+		return nil
+	}
+	c.Revocations = list
+	c.RevocationList = DER
+	c.RevocationMutex.Unlock()
+	c.CheckCertificates()
+	return nil
+}
+
+func (c *Cluster) RevocationListBytes() []byte {
+	c.RevocationMutex.RLock()
+	defer c.RevocationMutex.RUnlock()
+	return c.RevocationList
+}
+
+// CheckCertificates removes peers whose certificates expired or were revoked
+func (c *Cluster) CheckCertificates() {
+	if c.CA == nil {
+		return
+	}
+	removed := make([]string, 0)
+	for _, peer := range c.PeerList() {
+		if peer.ID == c.LocalPeer.ID {
+			continue
+		}
+		if c.AdmitPeer(&peer) != nil {
+			removed = append(removed, peer.ID)
+		}
+	}
+	c.PeersMutex.Lock()
+	for _, id := range removed {
+		c.removePeer(id)
+	}
+	c.PeersMutex.Unlock()
+	for _, id := range removed {
+		c.DropSessions(id)
+		c.DropSequences(id)
+		c.DropOrdering(id)
+		c.DropSubscriptions(id)
+	}
+}
+
+// PeerRoles returns the roles in a peer's certificate
+func (c *Cluster) PeerRoles(PeerID string) []string {
+	c.PeersMutex.RLock()
+	defer c.PeersMutex.RUnlock()
+	peer := c.Peers[PeerID]
+	if peer == nil {
+		return nil
+	}
+	return peer.Roles
+}
+
+// signedAdmission is what the member admitting a peer signs
+type signedAdmission struct {
+	ID        string
+	PublicKey []byte
+	Admitter  string
+}
+
+func admissionBytes(p Peer) ([]byte, error) {
+	admissionBytes := bytes.Buffer{}
+	err := gob.NewEncoder(&admissionBytes).Encode(signedAdmission{ID: p.ID, PublicKey: p.PublicKey, Admitter: p.Admitter})
+	return admissionBytes.Bytes(), err
+}
+
+// SignAdmission records this peer as the one admitting a joining peer, so
+// other members can take the joiner's key from whoever relays it
+func (c *Cluster) SignAdmission(p *Peer) error {
+	p.Admitter = c.LocalPeer.ID
+	data, err := admissionBytes(*p)
+	if err != nil {
+		return err
+	}
+	p.Admission, err = c.Suite.Sign(c.LocalPeer.identity, data)
+	return err
+}
+
+// bindsKey reports whether a peer's ID may be bound to the key it carries. A
+// certificate binds them. Otherwise the binding must come from the peer
+// itself, a sender vouching for it, or carry the signature of the member
+// that admitted the peer. PeersMutex must be held
+func (c *Cluster) bindsKey(p Peer, From string, Vouched bool) bool {
+	if c.CA != nil {
+		return true
+	}
+	if c.keyRetained(p.ID, p.PublicKey) {
+		return false
+	}
+	if p.ID == From || Vouched {
+		return true
+	}
+	admitter := c.AuthorKeys[p.Admitter]
+	if p.Admitter == "" || p.Admitter == p.ID || admitter == nil {
+		return false
+	}
+	data, err := admissionBytes(p)
+	if err != nil {
+		return false
+	}
+	return c.Suite.Verify(admitter, data, p.Admission) == nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestCA(t *testing.T) (*x509.Certificate, crypto.Signer) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster CA"},
+		NotBefore:             time.Unix(0, 0),
+		NotAfter:              time.Unix(0, 0).Add(time.Hour * 24),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	return ca, key
+}
+
+func TestCertificateAdmission(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	ca, caKey := newTestCA(t)
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	now := S.Clock.Now()
+	expires := []time.Duration{time.Hour, time.Hour, time.Hour, time.Minute}
+	for i, expiry := range expires {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		cert, err := IssueCertificate(ca, caKey, fmt.Sprintf("node-%06d", i), []string{"web"}, key.Public(), now, now.Add(expiry))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = S.AddCluster(&Cluster{Suite: Ed25519Suite{}, IdentityKey: key, CA: ca, Certificate: cert})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	//A node without a certificate is turned away
+	rogue := &Cluster{Suite: Ed25519Suite{}}
+	S.AddCluster(rogue)
+	S.Run(time.Second * 5)
+	C := S.Clusters[0]
+	if len(C.PeerList()) != 4 || C.Peers[rogue.LocalPeer.ID] != nil {
+		t.Error(errors.New("Only peers with certificates should join"))
+	}
+	if !reflect.DeepEqual(C.PeerRoles(S.Clusters[1].LocalPeer.ID), []string{"web"}) {
+		t.Error(errors.New("Roles were not taken from the certificate"))
+	}
+
+	//A certificate for another node ID does not start
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	cert, _ := IssueCertificate(ca, caKey, "someone-else", nil, key.Public(), now, now.Add(time.Hour))
+	if S.AddCluster(&Cluster{Suite: Ed25519Suite{}, IdentityKey: key, CA: ca, Certificate: cert}) == nil {
+		t.Error(errors.New("Certificate for another node should be rejected"))
+	}
+
+	//Expired certificates are dropped everywhere
+	S.Run(time.Minute)
+	for _, C := range S.Clusters[:3] {
+		if C.Peers[S.Clusters[3].LocalPeer.ID] != nil {
+			t.Error(errors.New("Peer with an expired certificate was not removed"))
+		}
+	}
+
+	//Revocations spread through gossip
+	revoked, _ := x509.ParseCertificate(S.Clusters[2].Certificate)
+	list, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                S.Clock.Now(),
+		NextUpdate:                S.Clock.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: revoked.SerialNumber, RevocationTime: S.Clock.Now()}},
+	}, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = S.Clusters[1].UpdateRevocationList(list)
+	if err != nil {
+		t.Error(err)
+	}
+	S.Run(time.Second * 10)
+	for _, C := range S.Clusters[:2] {
+		if len(C.PeerList()) != 2 {
+			t.Error(errors.New("Revoked peer was not removed everywhere"))
+		}
+	}
+	S.Shutdown()
+}
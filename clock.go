@@ -0,0 +1,157 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for gossip, timeouts and peer expiry
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+	After(d time.Duration) <-chan time.Time
+}
+
+type Timer interface {
+	Stop() bool
+}
+
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// VirtualClock only advances when its events are run, so timing is
+// controlled entirely by the caller
+type VirtualClock struct {
+	now    time.Time
+	events virtualEvents
+	//Sequence breaks ties so events at the same time run in scheduling order
+	sequence uint64
+	Mutex    *sync.Mutex
+}
+
+type virtualEvent struct {
+	At        time.Time
+	Sequence  uint64
+	Func      func()
+	Cancelled bool
+	index     int
+}
+
+type virtualEvents []*virtualEvent
+
+func (e virtualEvents) Len() int {
+	return len(e)
+}
+
+func (e virtualEvents) Less(i, j int) bool {
+	if e[i].At.Equal(e[j].At) {
+		return e[i].Sequence < e[j].Sequence
+	}
+	return e[i].At.Before(e[j].At)
+}
+
+func (e virtualEvents) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+	e[i].index = i
+	e[j].index = j
+}
+
+func (e *virtualEvents) Push(x interface{}) {
+	event := x.(*virtualEvent)
+	event.index = len(*e)
+	*e = append(*e, event)
+}
+
+func (e *virtualEvents) Pop() interface{} {
+	old := *e
+	event := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return event
+}
+
+type virtualTimer struct {
+	clock *VirtualClock
+	event *virtualEvent
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.clock.Mutex.Lock()
+	defer t.clock.Mutex.Unlock()
+	if t.event.Cancelled || t.event.index < 0 {
+		return false
+	}
+	t.event.Cancelled = true
+	return true
+}
+
+func NewVirtualClock(Start time.Time) *VirtualClock {
+	return &VirtualClock{now: Start, Mutex: new(sync.Mutex)}
+}
+
+func (v *VirtualClock) Now() time.Time {
+	v.Mutex.Lock()
+	defer v.Mutex.Unlock()
+	return v.now
+}
+
+func (v *VirtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	v.Mutex.Lock()
+	defer v.Mutex.Unlock()
+	v.sequence++
+	event := &virtualEvent{At: v.now.Add(d), Sequence: v.sequence, Func: f}
+	heap.Push(&v.events, event)
+	return &virtualTimer{clock: v, event: event}
+}
+
+func (v *VirtualClock) After(d time.Duration) <-chan time.Time {
+	c := make(chan time.Time, 1)
+	v.AfterFunc(d, func() {
+		c <- v.Now()
+	})
+	return c
+}
+
+// Step runs the next event no later than Until and reports whether one ran
+func (v *VirtualClock) Step(Until time.Time) bool {
+	v.Mutex.Lock()
+	for len(v.events) > 0 {
+		event := v.events[0]
+		if event.At.After(Until) {
+			break
+		}
+		heap.Pop(&v.events)
+		event.index = -1
+		if event.Cancelled {
+			continue
+		}
+		v.now = event.At
+		v.Mutex.Unlock()
+		//Run without the lock so the event can schedule more events
+		event.Func()
+		return true
+	}
+	v.Mutex.Unlock()
+	return false
+}
+
+// Advance runs every event due within d and then moves the clock to the end of d
+func (v *VirtualClock) Advance(d time.Duration) {
+	until := v.Now().Add(d)
+	for v.Step(until) {
+	}
+	v.Mutex.Lock()
+	v.now = until
+	v.Mutex.Unlock()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	order := make([]int, 0)
+	clock.AfterFunc(time.Second*2, func() {
+		order = append(order, 2)
+	})
+	clock.AfterFunc(time.Second, func() {
+		order = append(order, 1)
+		//Events scheduled by events run in the same advance
+		clock.AfterFunc(time.Second*3, func() {
+			order = append(order, 4)
+		})
+	})
+	timer := clock.AfterFunc(time.Second*3, func() {
+		order = append(order, 3)
+	})
+	if !timer.Stop() {
+		t.Error(errors.New("Pending timer should stop"))
+	}
+	clock.Advance(time.Second * 3)
+	if !reflect.DeepEqual(order, []int{1, 2}) {
+		t.Error(errors.New("Events did not run in time order"))
+	}
+	if !clock.Now().Equal(time.Unix(3, 0)) {
+		t.Error(errors.New("Clock did not advance"))
+	}
+	clock.Advance(time.Second * 2)
+	if !reflect.DeepEqual(order, []int{1, 2, 4}) {
+		t.Error(errors.New("Chained event did not run"))
+	}
+}
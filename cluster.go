@@ -1,7 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/big"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -9,94 +21,420 @@ import (
 )
 
 type Cluster struct {
-	Peers             map[string]*Peer
-	LastSeenPeer      map[string]int64
-	PeerIDs           []string
-	LocalPeer         Peer
-	Values            map[string]*Value
-	PeersMutex        *sync.RWMutex
-	LastSeenPeerMutex *sync.RWMutex
-	ValuesMutex       *sync.RWMutex
-	MaxConnections    int
+	Peers              map[string]*Peer
+	LastSeenPeer       map[string]int64
+	DepartedPeers      map[string]int64
+	PeerIDs            []string
+	LocalPeer          Peer
+	Values             map[string]*Value
+	PeersMutex         *sync.RWMutex
+	LastSeenPeerMutex  *sync.RWMutex
+	ValuesMutex        *sync.RWMutex
+	Handlers           map[string]MessageHandler
+	HandlersMutex      *sync.RWMutex
+	Methods            map[string]MethodHandler
+	MethodsMutex       *sync.RWMutex
+	PendingCalls       map[string]chan RPCResponse
+	PendingCallsMutex  *sync.Mutex
+	SendSequences      map[string]uint64
+	ReceivedSequences  map[string]*SequenceWindow
+	PendingAcks        map[string]chan bool
+	ReliableMutex      *sync.Mutex
+	RetransmitTimeout  time.Duration
+	MaxRetransmits     int
+	Reassembly         map[string]*SenderReassembly
+	ReassemblyMutex    *sync.Mutex
+	MTU                int
+	MaxMessageSize     int
+	MaxReassemblyBytes int
+	MaxPartialMessages int
+	ReassemblyTimeout  time.Duration
+	fragmentCounter    uint64
+	peerDigest         uint64
+	StreamThreshold    int
+	Transport          Transport
+	Clock              Clock
+	GossipInterval     time.Duration
+	PeerTimeout        time.Duration
+	Random             *rand.Rand
+	RandomMutex        *sync.Mutex
+	NodeID             string
+	Synchronous        bool
+	EventClock         uint64
+	RecentEvents       []UserEvent
+	SeenEvents         map[string]bool
+	EventHandlers      map[string][]EventHandler
+	EventsMutex        *sync.Mutex
+	MaxEvents          int
+	Tags               map[string]string
+	QueryHandlers      map[string]QueryHandler
+	PendingQueries     map[string]*QueryResponse
+	QueriesMutex       *sync.Mutex
+	Topics             map[string]TopicHandler
+	Subscriptions      map[string]TopicSubscription
+	SeenTopicMessages  map[string]bool
+	SeenTopicOrder     []string
+	TopicsMutex        *sync.Mutex
+	OrderSequences     map[string]uint64
+	OrderedSenders     map[string]*OrderedSender
+	OrderMutex         *sync.Mutex
+	OrderTimeout       time.Duration
+	MaxPendingOrdered  int
+	CausalClock        map[string]uint64
+	CausalSent         uint64
+	CausalPending      []UserEvent
+	CausalReady        []UserEvent
+	CausalDelivering   bool
+	CausalMutex        *sync.Mutex
+	ReceiveWorkers     int
+	ReceiveQueueSize   int
+	ReceiveQueues      []chan func()
+	stopWorkers        chan bool
+	HandlerQueues      map[string]*HandlerQueue
+	MaxDetached        int
+	Detached           int
+	RateLimit          float64
+	RateBurst          int
+	RateBuckets        map[string]*RateBucket
+	Drops              map[string]uint64
+	ReceiveMutex       *sync.Mutex
+	Suite              Suite
+	IdentityKey        crypto.Signer
+	IdentityKeyLength  int
+	ReplayWindow       time.Duration
+	MaxSeenMessages    int
+	ReplayCaches       map[string]*ReplayCache
+	SecurityEvents     map[string]uint64
+	ReplayMutex        *sync.Mutex
+	Sessions           map[string]*Session
+	SessionsByID       map[string]*Session
+	PendingHandshakes  map[string]*PendingHandshake
+	SessionsMutex      *sync.Mutex
+	RekeyInterval      time.Duration
+	RekeyMessages      uint64
+	MaxQueuedMessages  int
+	Keys               []rsa.PrivateKey
+	KeyringVersion     uint64
+	KeyringOrigin      string
+	sealedKeyring      *KeyringState
+	KeyringMutex       *sync.RWMutex
+	CA                 *x509.Certificate
+	Certificate        []byte
+	Revocations        *x509.RevocationList
+	RevocationList     []byte
+	RevocationMutex    *sync.RWMutex
+	Invites            map[string]*Invite
+	JoinInvite         *InviteToken
+	Joining            *PendingJoin
+	InvitesMutex       *sync.Mutex
+	ACL                []ACLRule
+	AuthorKeys         map[string][]byte
+	NamespaceKeys      map[string][]byte
+	NamespaceMutex     *sync.RWMutex
+	Scores             map[string]int
+	BanList            map[string]Ban
+	BanThreshold       int
+	BanDuration        time.Duration
+	BanIssuers         []string
+	ReputationMutex    *sync.Mutex
+	MaxConnections     int
 }
 
+type MessageHandler func(From string, Payload []byte)
+
+type MethodHandler func(From string, Request []byte) ([]byte, error)
+
 type Value struct {
 	Modified               int64
 	ConflictResolutionMode int
+	//Peer ID of the last writer, checked against the ACL
+	Author string
+	//The author's identity key and its signature over the value
+	AuthorKey []byte
+	Signature []byte
+	//Vouches for the author's key and roles to peers that never met it
+	AuthorCertificate []byte
+	//Replaces Value in an encrypted namespace
+	Sealed *SealedValue
 	// File                   *filetransfer.File
 	// Wanted bool
 	Value map[string]interface{}
 }
 
+// PendingJoin is a bootstrap waiting for the seed's reply
+type PendingJoin struct {
+	Seed          Peer
+	CorrelationID string
+}
+
 func (c *Cluster) Bootstrap(LocalIP, RemoteIP string, LocalPort, RemotePort int, Key rsa.PrivateKey, MaxConnections int) error {
-	c.MaxConnections = MaxConnections
-	c.Peers = make(map[string]*Peer)
-	c.PeerIDs = make([]string, 0)
-	c.LastSeenPeer = make(map[string]int64)
-	c.Values = make(map[string]*Value)
-	// c.DownloadQueue = make(chan ChunkRequest, 100000)
-	c.PeersMutex = new(sync.RWMutex)
-	c.LastSeenPeerMutex = new(sync.RWMutex)
-	c.ValuesMutex = new(sync.RWMutex)
-	uuid, err := uuid.NewUUID()
+	err := c.Start(LocalIP, LocalPort, Key, MaxConnections)
 	if err != nil {
 		return err
 	}
-	c.LocalPeer = Peer{IP: LocalIP, Port: LocalPort, ID: uuid.String(), parentCluster: c}
-	c.Peers[c.LocalPeer.ID] = &Peer{IP: LocalIP, Port: LocalPort, ID: uuid.String(), Stopped: false}
-	c.PeerIDs = append(c.PeerIDs, uuid.String())
-	err = c.LocalPeer.InitializeRSAUtil(2048, &Key)
+
+	RemotePeer := Peer{IP: RemoteIP, Port: RemotePort}
+	//The seed echoes the correlation ID, tying its reply to this request
+	correlationID, err := uuid.NewRandom()
 	if err != nil {
 		return err
 	}
-	err = c.LocalPeer.StartListening()
+	pending := &PendingJoin{Seed: RemotePeer, CorrelationID: correlationID.String()}
+	c.InvitesMutex.Lock()
+	c.Joining = pending
+	c.InvitesMutex.Unlock()
+	//The cluster key admits the joiner, which announces its own identity key
+	M := Message{Header: Header{ID: 0, From: c.LocalPeer.ID, CorrelationID: pending.CorrelationID}, Body: Body{Content: Peer{IP: LocalIP, Port: LocalPort, ID: c.LocalPeer.ID, Tags: c.Tags, Suite: c.LocalPeer.Suite, PublicKey: c.LocalPeer.PublicKey, Certificate: c.Certificate}}}
+	err = c.sendBootstrap(RemotePeer, M)
 	if err != nil {
 		return err
 	}
-	err = c.LocalPeer.StartGossip()
+	c.Clock.AfterFunc(c.GossipInterval*2, func() {
+		c.retryBootstrap(pending, M, c.GossipInterval*4, 1)
+	})
+	return nil
+}
+
+func (c *Cluster) sendBootstrap(RemotePeer Peer, M Message) error {
+	messageBytes, err := c.LocalPeer.EncodeAdmissionMessage(M)
 	if err != nil {
 		return err
 	}
+	return c.LocalPeer.WritePacket(RemotePeer, messageBytes)
+}
 
-	// err = c.LocalPeer.StartDownloaders()
-	// if err != nil {
-	// 	return err
-	// }
+// retryBootstrap sends the bootstrap again, backing off, until the seed has
+// answered with the cluster's peers. Each attempt is encoded afresh so the
+// seed's replay protection does not drop it
+func (c *Cluster) retryBootstrap(Pending *PendingJoin, M Message, timeout time.Duration, attempt int) {
+	c.InvitesMutex.Lock()
+	joined := c.Joining != Pending
+	c.InvitesMutex.Unlock()
+	if joined || c.LocalPeer.Stopped() || attempt > c.MaxRetransmits {
+		return
+	}
+	c.sendBootstrap(Pending.Seed, M)
+	c.Clock.AfterFunc(timeout, func() {
+		c.retryBootstrap(Pending, M, timeout*2, attempt+1)
+	})
+}
 
-	RemotePeer := Peer{IP: RemoteIP, Port: RemotePort}
-	RemotePeer.InitializeRSAUtil(2048, &Key)
-	if err != nil {
-		return err
+// AcceptJoinReply lets the cluster key carry the cluster's state only to a
+// node waiting on its bootstrap, and only from the seed it contacted. The
+// reply is accepted once
+func (c *Cluster) AcceptJoinReply(m *Message) error {
+	c.InvitesMutex.Lock()
+	defer c.InvitesMutex.Unlock()
+	if c.Joining == nil || m.Header.CorrelationID != c.Joining.CorrelationID {
+		return errors.New("Unexpected bootstrap reply")
 	}
-	M := Message{Header: Header{ID: 0, From: c.LocalPeer.ID}, Body: Body{Content: Peer{IP: LocalIP, Port: LocalPort, ID: c.LocalPeer.ID}}}
-	err = c.LocalPeer.SendMessage(RemotePeer, M)
-	if err != nil {
-		return err
+	gossip, ok := m.Body.Content.(Gossip)
+	if !ok {
+		return errors.New("Malformed bootstrap reply")
 	}
-	return nil
+	seed := c.Joining.Seed
+	for _, peer := range gossip.Peers {
+		if peer.ID == m.Header.From && peer.IP == seed.IP && peer.Port == seed.Port {
+			c.Joining = nil
+			return nil
+		}
+	}
+	return errors.New("Bootstrap reply is not from the seed")
 }
 
 func (c *Cluster) Start(LocalIP string, LocalPort int, Key rsa.PrivateKey, MaxConnections int) error {
 	c.MaxConnections = MaxConnections
 	c.Peers = make(map[string]*Peer)
+	c.AuthorKeys = make(map[string][]byte)
 	c.PeerIDs = make([]string, 0)
 	c.LastSeenPeer = make(map[string]int64)
+	c.DepartedPeers = make(map[string]int64)
 	c.Values = make(map[string]*Value)
 	// c.DownloadQueue = make(chan ChunkRequest, 100000)
 	c.PeersMutex = new(sync.RWMutex)
 	c.LastSeenPeerMutex = new(sync.RWMutex)
 	c.ValuesMutex = new(sync.RWMutex)
-	uuid, err := uuid.NewUUID()
+	c.Handlers = make(map[string]MessageHandler)
+	c.HandlersMutex = new(sync.RWMutex)
+	c.Methods = make(map[string]MethodHandler)
+	c.MethodsMutex = new(sync.RWMutex)
+	c.PendingCalls = make(map[string]chan RPCResponse)
+	c.PendingCallsMutex = new(sync.Mutex)
+	c.SendSequences = make(map[string]uint64)
+	c.ReceivedSequences = make(map[string]*SequenceWindow)
+	c.PendingAcks = make(map[string]chan bool)
+	c.ReliableMutex = new(sync.Mutex)
+	if c.RetransmitTimeout == 0 {
+		c.RetransmitTimeout = time.Millisecond * 200
+	}
+	if c.MaxRetransmits == 0 {
+		c.MaxRetransmits = 5
+	}
+	c.Reassembly = make(map[string]*SenderReassembly)
+	c.ReassemblyMutex = new(sync.Mutex)
+	if c.MTU == 0 {
+		c.MTU = 1400
+	}
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = 1 << 20
+	}
+	if c.MaxReassemblyBytes == 0 {
+		c.MaxReassemblyBytes = 4 << 20
+	}
+	if c.MaxPartialMessages == 0 {
+		c.MaxPartialMessages = 16
+	}
+	if c.ReassemblyTimeout == 0 {
+		c.ReassemblyTimeout = time.Second * 5
+	}
+	if c.StreamThreshold == 0 {
+		c.StreamThreshold = 64 << 10
+	}
+	if c.Transport == nil {
+		c.Transport = NewNetTransport()
+	}
+	if c.Clock == nil {
+		c.Clock = RealClock{}
+	}
+	if c.GossipInterval == 0 {
+		c.GossipInterval = time.Millisecond * 500
+	}
+	if c.PeerTimeout == 0 {
+		c.PeerTimeout = time.Second * 60
+	}
+	if c.Random == nil {
+		seed, err := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
+		if err != nil {
+			return err
+		}
+		c.Random = rand.New(rand.NewSource(seed.Int64()))
+	}
+	c.RandomMutex = new(sync.Mutex)
+	c.RecentEvents = make([]UserEvent, 0)
+	c.SeenEvents = make(map[string]bool)
+	c.EventHandlers = make(map[string][]EventHandler)
+	c.EventsMutex = new(sync.Mutex)
+	if c.MaxEvents == 0 {
+		c.MaxEvents = 128
+	}
+	c.QueryHandlers = make(map[string]QueryHandler)
+	c.PendingQueries = make(map[string]*QueryResponse)
+	c.QueriesMutex = new(sync.Mutex)
+	c.Topics = make(map[string]TopicHandler)
+	c.Subscriptions = make(map[string]TopicSubscription)
+	c.SeenTopicMessages = make(map[string]bool)
+	c.SeenTopicOrder = make([]string, 0)
+	c.TopicsMutex = new(sync.Mutex)
+	c.OrderSequences = make(map[string]uint64)
+	c.OrderedSenders = make(map[string]*OrderedSender)
+	c.OrderMutex = new(sync.Mutex)
+	if c.OrderTimeout == 0 {
+		c.OrderTimeout = time.Second
+	}
+	if c.MaxPendingOrdered == 0 {
+		c.MaxPendingOrdered = 1024
+	}
+	c.CausalClock = make(map[string]uint64)
+	c.CausalPending = make([]UserEvent, 0)
+	c.CausalMutex = new(sync.Mutex)
+	if c.ReceiveWorkers == 0 {
+		c.ReceiveWorkers = runtime.NumCPU()
+	}
+	if c.ReceiveQueueSize == 0 {
+		c.ReceiveQueueSize = 256
+	}
+	if c.MaxDetached == 0 {
+		c.MaxDetached = 64
+	}
+	//A negative rate limit turns limiting off
+	if c.RateLimit == 0 {
+		c.RateLimit = 2000
+	}
+	if c.RateBurst == 0 {
+		c.RateBurst = 4000
+	}
+	c.RateBuckets = make(map[string]*RateBucket)
+	c.Drops = make(map[string]uint64)
+	c.HandlerQueues = make(map[string]*HandlerQueue)
+	c.ReceiveMutex = new(sync.Mutex)
+	if c.IdentityKeyLength == 0 {
+		c.IdentityKeyLength = 2048
+	}
+	if c.Suite == nil {
+		c.Suite = RSASuite{Length: c.IdentityKeyLength}
+	}
+	if c.ReplayWindow == 0 {
+		c.ReplayWindow = time.Minute
+	}
+	if c.MaxSeenMessages == 0 {
+		c.MaxSeenMessages = 4096
+	}
+	c.ReplayCaches = make(map[string]*ReplayCache)
+	c.SecurityEvents = make(map[string]uint64)
+	c.ReplayMutex = new(sync.Mutex)
+	c.Sessions = make(map[string]*Session)
+	c.SessionsByID = make(map[string]*Session)
+	c.PendingHandshakes = make(map[string]*PendingHandshake)
+	c.SessionsMutex = new(sync.Mutex)
+	if c.RekeyInterval == 0 {
+		c.RekeyInterval = time.Minute * 10
+	}
+	if c.RekeyMessages == 0 {
+		c.RekeyMessages = 1 << 20
+	}
+	if c.MaxQueuedMessages == 0 {
+		c.MaxQueuedMessages = 64
+	}
+	if c.NodeID == "" {
+		uuid, err := uuid.NewUUID()
+		if err != nil {
+			return err
+		}
+		c.NodeID = uuid.String()
+	}
+	c.LocalPeer = Peer{IP: LocalIP, Port: LocalPort, ID: c.NodeID, Tags: c.Tags, parentCluster: c, transport: c.Transport}
+	//The cluster key starts the keyring and can be rotated out later. A node
+	//joining with an invite starts without one
+	c.Keys = nil
+	if Key.N != nil {
+		c.Keys = []rsa.PrivateKey{Key}
+	}
+	c.KeyringMutex = new(sync.RWMutex)
+	c.RevocationMutex = new(sync.RWMutex)
+	c.Invites = make(map[string]*Invite)
+	c.InvitesMutex = new(sync.Mutex)
+	if c.NamespaceKeys == nil {
+		c.NamespaceKeys = make(map[string][]byte)
+	}
+	c.NamespaceMutex = new(sync.RWMutex)
+	//A negative threshold turns banning off
+	if c.BanThreshold == 0 {
+		c.BanThreshold = 100
+	}
+	if c.BanDuration == 0 {
+		c.BanDuration = time.Minute * 10
+	}
+	c.Scores = make(map[string]int)
+	c.BanList = make(map[string]Ban)
+	c.ReputationMutex = new(sync.Mutex)
+	//Each node signs and decrypts with its own key, generated unless provided
+	err := c.LocalPeer.InitializeIdentity(c.Suite, c.IdentityKey)
 	if err != nil {
 		return err
 	}
-	c.LocalPeer = Peer{IP: LocalIP, Port: LocalPort, ID: uuid.String(), parentCluster: c}
-	c.Peers[c.LocalPeer.ID] = &Peer{IP: LocalIP, Port: LocalPort, ID: uuid.String(), Stopped: false}
-	c.PeerIDs = append(c.PeerIDs, uuid.String())
-	err = c.LocalPeer.InitializeRSAUtil(2048, &Key)
+	c.IdentityKey = c.LocalPeer.identity
+	c.LocalPeer.Certificate = c.Certificate
+	local := &Peer{IP: LocalIP, Port: LocalPort, ID: c.NodeID, Tags: c.Tags, Suite: c.LocalPeer.Suite, PublicKey: c.LocalPeer.PublicKey, Certificate: c.Certificate}
+	//Catch a certificate other peers would reject before joining
+	err = c.AdmitPeer(local)
 	if err != nil {
 		return err
 	}
+	c.LocalPeer.Roles = local.Roles
+	c.addPeer(local)
+	if !c.Synchronous {
+		c.StartWorkers()
+	}
 	err = c.LocalPeer.StartListening()
 	if err != nil {
 		return err
@@ -117,60 +455,278 @@ func (c *Cluster) Shutdown() error {
 	if err != nil {
 		return err
 	}
+	c.StopWorkers()
+	return nil
+}
+
+func (c *Cluster) RegisterHandler(Type string, Handler MessageHandler) error {
+	if Handler == nil {
+		return errors.New("Handler can not be nil")
+	}
+	c.HandlersMutex.Lock()
+	c.Handlers[Type] = Handler
+	c.HandlersMutex.Unlock()
+	return nil
+}
+
+func (c *Cluster) Send(PeerID, Type string, Payload []byte) error {
+	c.PeersMutex.RLock()
+	peer := c.Peers[PeerID]
+	c.PeersMutex.RUnlock()
+	if peer == nil {
+		return errors.New("Unknown peer")
+	}
+	M := Message{Header: Header{ID: 4, From: c.LocalPeer.ID, Order: c.NextOrder(PeerID)}, Body: Body{Content: DirectMessage{Type: Type, Payload: Payload}}}
+	return c.LocalPeer.SendMessage(*peer, M)
+}
+
+func (c *Cluster) SendReliable(PeerID, Type string, Payload []byte) error {
+	c.PeersMutex.RLock()
+	peer := c.Peers[PeerID]
+	c.PeersMutex.RUnlock()
+	if peer == nil {
+		return errors.New("Unknown peer")
+	}
+	M := Message{Header: Header{ID: 4, From: c.LocalPeer.ID, Order: c.NextOrder(PeerID)}, Body: Body{Content: DirectMessage{Type: Type, Payload: Payload}}}
+	return c.LocalPeer.SendReliableMessage(*peer, M)
+}
+
+func (c *Cluster) RegisterMethod(Method string, Handler MethodHandler) error {
+	if Handler == nil {
+		return errors.New("Handler can not be nil")
+	}
+	c.MethodsMutex.Lock()
+	c.Methods[Method] = Handler
+	c.MethodsMutex.Unlock()
 	return nil
 }
 
+func (c *Cluster) Call(ctx context.Context, PeerID, Method string, Request []byte) ([]byte, error) {
+	c.PeersMutex.RLock()
+	peer := c.Peers[PeerID]
+	c.PeersMutex.RUnlock()
+	if peer == nil {
+		return nil, errors.New("Unknown peer")
+	}
+	correlationID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	//Register the pending call before sending so a fast response is not missed
+	pending := make(chan RPCResponse, 1)
+	c.PendingCallsMutex.Lock()
+	c.PendingCalls[correlationID.String()] = pending
+	c.PendingCallsMutex.Unlock()
+	defer func() {
+		c.PendingCallsMutex.Lock()
+		delete(c.PendingCalls, correlationID.String())
+		c.PendingCallsMutex.Unlock()
+	}()
+
+	M := Message{Header: Header{ID: 5, From: c.LocalPeer.ID, CorrelationID: correlationID.String()}, Body: Body{Content: RPCRequest{Method: Method, Payload: Request}}}
+	err = c.LocalPeer.SendMessage(*peer, M)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-pending:
+		if response.Error != "" {
+			return response.Payload, errors.New(response.Error)
+		}
+		return response.Payload, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 func (c *Cluster) AgeOutPeers() error {
-	c.LastSeenPeerMutex.RLock()
-	lastSeenPeer := c.LastSeenPeer
-	c.LastSeenPeerMutex.RUnlock()
-	for i := range lastSeenPeer {
-		if time.Now().UTC().Unix()-lastSeenPeer[i] > 60 {
-			c.LastSeenPeerMutex.Lock()
+	now := c.Clock.Now().UTC().Unix()
+	expired := make([]string, 0)
+	c.LastSeenPeerMutex.Lock()
+	for i := range c.LastSeenPeer {
+		if now-c.LastSeenPeer[i] > int64(c.PeerTimeout/time.Second) {
 			delete(c.LastSeenPeer, i)
-			c.LastSeenPeerMutex.Unlock()
-
-			c.PeersMutex.Lock()
-			delete(c.Peers, i)
-			c.PeersMutex.Unlock()
-			for index := 0; index < len(c.PeerIDs); index++ {
-				if c.PeerIDs[index] == i {
-					c.PeerIDs = append(c.PeerIDs[:index], c.PeerIDs[index+1:]...)
-				}
-			}
+			expired = append(expired, i)
+			//Remember the peer so gossip from peers yet to age it out does not re-add it
+			c.DepartedPeers[i] = now
 		}
 	}
+	for i := range c.DepartedPeers {
+		if now-c.DepartedPeers[i] > int64(c.PeerTimeout/time.Second) {
+			delete(c.DepartedPeers, i)
+		}
+	}
+	c.LastSeenPeerMutex.Unlock()
+
+	for _, i := range expired {
+		c.DropSessions(i)
+		c.DropSequences(i)
+		c.DropOrdering(i)
+	}
+	c.PeersMutex.Lock()
+	for _, i := range expired {
+		c.removePeer(i)
+	}
+	c.PeersMutex.Unlock()
+	//Only after the peer is gone, so gossip can not bring its subscriptions back
+	for _, i := range expired {
+		c.DropSubscriptions(i)
+	}
 	return nil
 }
 
+// PeerList returns a copy of every known peer sorted by ID
+func (c *Cluster) PeerList() []Peer {
+	peers := make([]Peer, 0)
+	c.PeersMutex.RLock()
+	for _, peer := range c.Peers {
+		peers = append(peers, Peer{ID: peer.ID, IP: peer.IP, Port: peer.Port, Tags: peer.Tags, Suite: peer.Suite, PublicKey: peer.PublicKey, Certificate: peer.Certificate, Roles: peer.Roles, Admitter: peer.Admitter, Admission: peer.Admission})
+	}
+	c.PeersMutex.RUnlock()
+	//Sorted so the order peers are learned in does not depend on map iteration
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+	return peers
+}
+
+// GossipState snapshots the peers and values shared with a peer, leaving out
+// values the ACL does not let it read
+func (c *Cluster) GossipState(PeerID string) Gossip {
+	state := c.GossipDigest(PeerID)
+	state.Peers = c.PeerList()
+	return state
+}
+
+// GossipDigest is the gossip state with a digest in place of the peer list,
+// which is most of a message in a large cluster and rarely changes
+func (c *Cluster) GossipDigest(PeerID string) Gossip {
+	values := make(map[string]*Value)
+	c.ValuesMutex.RLock()
+	for key, value := range c.Values {
+		if c.CanRead(PeerID, key) {
+			values[key] = value
+		}
+	}
+	c.ValuesMutex.RUnlock()
+	return Gossip{PeerDigest: c.PeerDigest(), Values: values, Events: c.RecentEventList(), Subscriptions: c.SubscriptionList(), Keyring: c.KeyringState(), Revocations: c.RevocationListBytes(), Bans: c.GossipBans()}
+}
+
+// PeerDigest summarises the known peer IDs independent of their order
+func (c *Cluster) PeerDigest() uint64 {
+	c.PeersMutex.RLock()
+	defer c.PeersMutex.RUnlock()
+	return c.peerDigest
+}
+
+func peerHash(ID string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(ID))
+	return hash.Sum64()
+}
+
+// addPeer registers a peer not known before. PeersMutex must be held
+func (c *Cluster) addPeer(p *Peer) {
+	c.Peers[p.ID] = p
+	c.PeerIDs = append(c.PeerIDs, p.ID)
+	c.peerDigest += peerHash(p.ID)
+	//Kept after the peer leaves so the values it wrote still verify, and never
+	//replaced so a later peer can not take over the ID
+	if _, ok := c.AuthorKeys[p.ID]; !ok {
+		c.AuthorKeys[p.ID] = p.PublicKey
+	}
+}
+
+// removePeer forgets a peer. PeersMutex must be held
+func (c *Cluster) removePeer(ID string) {
+	if c.Peers[ID] == nil {
+		return
+	}
+	delete(c.Peers, ID)
+	for index := 0; index < len(c.PeerIDs); index++ {
+		if c.PeerIDs[index] == ID {
+			c.PeerIDs = append(c.PeerIDs[:index], c.PeerIDs[index+1:]...)
+			break
+		}
+	}
+	c.peerDigest -= peerHash(ID)
+}
+
+// RandomPeers picks up to Count distinct peers other than the local peer.
+// Only the chosen peers are copied, as this runs every gossip round
+func (c *Cluster) RandomPeers(Count int) []Peer {
+	c.PeersMutex.RLock()
+	defer c.PeersMutex.RUnlock()
+	ids := append([]string(nil), c.PeerIDs...)
+	peers := make([]Peer, 0, Count)
+	c.RandomMutex.Lock()
+	defer c.RandomMutex.Unlock()
+	for i := 0; i < len(ids) && len(peers) < Count; i++ {
+		j := i + c.Random.Intn(len(ids)-i)
+		ids[i], ids[j] = ids[j], ids[i]
+		peer := c.Peers[ids[i]]
+		if ids[i] != c.LocalPeer.ID && peer != nil && !c.IsBanned(ids[i]) {
+			peers = append(peers, *peer)
+		}
+	}
+	return peers
+}
+
+// ParseNewValues merges gossiped values, skipping any whose author may not
+// write them or whose signature does not check out
 func (c *Cluster) ParseNewValues(values map[string]*Value) error {
+	rejected := 0
 	c.ValuesMutex.Lock()
 	for key := range values {
 		value := values[key]
+		if c.Values[key] != nil && value.Modified <= c.Values[key].Modified {
+			continue
+		}
+		author, err := c.valueAuthor(value)
+		if err == errUnknownAuthor {
+			//Left for a later round, the relay is not to blame
+			continue
+		}
+		//Only the author's rights count, whichever peer relayed the value
+		if err == nil && !c.canWriteAs(author, key) {
+			c.CountSecurityEvent(SecurityUnauthorized)
+			rejected++
+			continue
+		}
+		if err != nil || c.verifyValueBy(key, value, author) != nil {
+			c.CountSecurityEvent(SecurityTampered)
+			rejected++
+			continue
+		}
 		if c.Values[key] == nil {
 			// value.File.AvailableChunks = 0
 			// value.File.ChunkAvailability = make([]bool, int(value.File.NumberOfChunks))
 			// value.Wanted = false
 			c.Values[key] = value
-		} else if value.ConflictResolutionMode == 0 { //Use the newer value
-			if value.Modified > c.Values[key].Modified {
-				c.Values[key] = value
-			}
+		} else if value.ConflictResolutionMode == 0 || value.Sealed != nil || c.Values[key].Sealed != nil { //Use the newer value, as encrypted contents can not be merged
+			c.Values[key] = value
 		} else if value.ConflictResolutionMode == 1 { //Merge keeping newer values
-			if value.Modified > c.Values[key].Modified {
-				for subKey := range value.Value {
-					if c.Values[key].Value[subKey] == nil {
-						c.Values[key].Value[subKey] = value.Value[subKey]
-					} else {
-						c.Values[key].Value[subKey] = value.Value[subKey]
-					}
-				}
-				c.Values[key].Modified = value.Modified
+			merged := &Value{Modified: value.Modified, ConflictResolutionMode: 1, Value: make(map[string]interface{})}
+			for subKey := range c.Values[key].Value {
+				merged.Value[subKey] = c.Values[key].Value[subKey]
+			}
+			for subKey := range value.Value {
+				merged.Value[subKey] = value.Value[subKey]
+			}
+			//The merge is a new write, so it is signed by this peer when it may
+			//write the key and otherwise the newer value is taken as it is
+			if c.CanWrite(c.LocalPeer.ID, key) && c.SignValue(key, merged) == nil {
+				c.Values[key] = merged
+			} else {
+				c.Values[key] = value
 			}
-
 		}
 	}
 	c.ValuesMutex.Unlock()
+	if rejected > 0 {
+		return errors.New("Rejected " + strconv.Itoa(rejected) + " unauthorized or tampered values")
+	}
 	return nil
 }
 
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"testing"
 	"time"
 )
 
+func waitForPeer(C *Cluster, PeerID string) bool {
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		C.PeersMutex.RLock()
+		peer := C.Peers[PeerID]
+		C.PeersMutex.RUnlock()
+		if peer != nil {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
+
 func TestStart(t *testing.T) {
 
 	RSA := RSAUtil{}
@@ -74,3 +89,104 @@ func TestBootstrap(t *testing.T) {
 	C2.Shutdown()
 	C3.Shutdown()
 }
+
+func TestSend(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(2048)
+	RSA.GenerateKey()
+	network := NewMemoryNetwork()
+	C := Cluster{Transport: network.NewTransport()}
+	C.Start("127.0.0.1", 8080, RSA.Key, 1)
+	C2 := Cluster{Transport: network.NewTransport()}
+	C2.Bootstrap("127.0.0.1", "127.0.0.1", 8082, 8080, RSA.Key, 1)
+	received := make(chan []byte, 1)
+	C2.RegisterHandler("greeting", func(From string, Payload []byte) {
+		if From == C.LocalPeer.ID {
+			received <- Payload
+		}
+	})
+	waitForPeer(&C, C2.LocalPeer.ID)
+	waitForPeer(&C2, C.LocalPeer.ID)
+	err := C.Send(C2.LocalPeer.ID, "greeting", []byte("Hello"))
+	if err != nil {
+		t.Error(err)
+	}
+	select {
+	case payload := <-received:
+		if string(payload) != "Hello" {
+			t.Error(errors.New("Payload did not arrive intact"))
+		}
+	case <-time.After(time.Second * 2):
+		t.Error(errors.New("Message was not delivered"))
+	}
+	err = C.Send("unknown", "greeting", []byte("Hello"))
+	if err == nil {
+		t.Error(errors.New("Sending to an unknown peer should fail"))
+	}
+	C.Shutdown()
+	C2.Shutdown()
+}
+
+func TestCall(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(2048)
+	RSA.GenerateKey()
+	network := NewMemoryNetwork()
+	C := Cluster{Transport: network.NewTransport()}
+	C.Start("127.0.0.1", 8080, RSA.Key, 1)
+	C2 := Cluster{Transport: network.NewTransport()}
+	C2.Bootstrap("127.0.0.1", "127.0.0.1", 8082, 8080, RSA.Key, 1)
+	C2.RegisterMethod("echo", func(From string, Request []byte) ([]byte, error) {
+		return Request, nil
+	})
+	C2.RegisterMethod("slow", func(From string, Request []byte) ([]byte, error) {
+		time.Sleep(time.Second * 2)
+		return Request, nil
+	})
+	//A handler calling back into its caller must not block the reply
+	C.RegisterMethod("name", func(From string, Request []byte) ([]byte, error) {
+		return []byte(C.LocalPeer.ID), nil
+	})
+	C2.RegisterMethod("callback", func(From string, Request []byte) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return C2.Call(ctx, From, "name", Request)
+	})
+	waitForPeer(&C, C2.LocalPeer.ID)
+	waitForPeer(&C2, C.LocalPeer.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	response, err := C.Call(ctx, C2.LocalPeer.ID, "echo", []byte("Hello"))
+	cancel()
+	if err != nil {
+		t.Error(err)
+	}
+	if string(response) != "Hello" {
+		t.Error(errors.New("Response did not match request"))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*2)
+	_, err = C.Call(ctx, C2.LocalPeer.ID, "missing", []byte("Hello"))
+	cancel()
+	if err == nil {
+		t.Error(errors.New("Calling an unknown method should fail"))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*2)
+	response, err = C.Call(ctx, C2.LocalPeer.ID, "callback", nil)
+	cancel()
+	if err != nil || string(response) != C.LocalPeer.ID {
+		t.Error(errors.New("Handler could not call back into its caller"))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*500)
+	_, err = C.Call(ctx, C2.LocalPeer.ID, "slow", []byte("Hello"))
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Error(errors.New("Call should honour the context deadline"))
+	}
+	C.Shutdown()
+	C2.Shutdown()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+type UserEvent struct {
+	ID      string
+	Name    string
+	Payload []byte
+	LTime   uint64
+	Origin  string
+	//Vector timestamp of causal events, nil for unordered events
+	Vector map[string]uint64
+}
+
+type EventHandler func(Event UserEvent)
+
+// Broadcast sends an event to every peer in the cluster, including this one
+func (c *Cluster) Broadcast(Name string, Payload []byte) error {
+	return c.broadcast(Name, Payload, nil)
+}
+
+// BroadcastCausal sends an event that every peer delivers only after the
+// causal events this peer had delivered before sending it
+func (c *Cluster) BroadcastCausal(Name string, Payload []byte) error {
+	return c.broadcast(Name, Payload, c.NextCausalVector())
+}
+
+func (c *Cluster) broadcast(Name string, Payload []byte, Vector map[string]uint64) error {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+	c.EventsMutex.Lock()
+	c.EventClock++
+	event := UserEvent{ID: id.String(), Name: Name, Payload: Payload, LTime: c.EventClock, Origin: c.LocalPeer.ID, Vector: Vector}
+	c.EventsMutex.Unlock()
+	c.ReceiveEvent(event)
+	return c.LocalPeer.SpreadEvent(event)
+}
+
+func (c *Cluster) SubscribeEvent(Name string, Handler EventHandler) error {
+	if Handler == nil {
+		return errors.New("Handler can not be nil")
+	}
+	c.EventsMutex.Lock()
+	c.EventHandlers[Name] = append(c.EventHandlers[Name], Handler)
+	c.EventsMutex.Unlock()
+	return nil
+}
+
+// ReceiveEvent records an event and delivers it to subscribers, reporting
+// false for events already seen or too old to be remembered
+func (c *Cluster) ReceiveEvent(Event UserEvent) bool {
+	c.EventsMutex.Lock()
+	//Witness the Lamport time of the event
+	if Event.LTime >= c.EventClock {
+		c.EventClock = Event.LTime + 1
+	}
+	if c.SeenEvents[Event.ID] {
+		c.EventsMutex.Unlock()
+		return false
+	}
+	//Once the buffer is full anything older than it can not be deduplicated
+	if len(c.RecentEvents) >= c.MaxEvents && Event.LTime < c.RecentEvents[0].LTime {
+		c.EventsMutex.Unlock()
+		return false
+	}
+	//Keep recent events ordered by Lamport time and evict the oldest
+	index := sort.Search(len(c.RecentEvents), func(i int) bool {
+		return c.RecentEvents[i].LTime > Event.LTime
+	})
+	c.RecentEvents = append(c.RecentEvents, UserEvent{})
+	copy(c.RecentEvents[index+1:], c.RecentEvents[index:])
+	c.RecentEvents[index] = Event
+	c.SeenEvents[Event.ID] = true
+	if len(c.RecentEvents) > c.MaxEvents {
+		delete(c.SeenEvents, c.RecentEvents[0].ID)
+		c.RecentEvents = c.RecentEvents[1:]
+	}
+	c.EventsMutex.Unlock()
+
+	//Causal events wait until the events they depend on have been delivered
+	if Event.Vector != nil {
+		c.DeliverCausal(Event)
+	} else {
+		c.deliverEvent(Event)
+	}
+	return true
+}
+
+func (c *Cluster) deliverEvent(Event UserEvent) {
+	c.EventsMutex.Lock()
+	handlers := append(append([]EventHandler(nil), c.EventHandlers[Event.Name]...), c.EventHandlers[""]...)
+	c.EventsMutex.Unlock()
+	for _, handler := range handlers {
+		handler(Event)
+	}
+}
+
+func (c *Cluster) RecentEventList() []UserEvent {
+	c.EventsMutex.Lock()
+	defer c.EventsMutex.Unlock()
+	return append([]UserEvent(nil), c.RecentEvents...)
+}
+
+func (p *Peer) SpreadEvent(Event UserEvent) error {
+	//Spread to up to five random peers like new peers are
+	M := Message{Header: Header{ID: 8, From: p.ID}, Body: Body{Content: Event}}
+	for _, peer := range p.parentCluster.RandomPeers(5) {
+		p.SendMessage(peer, M)
+	}
+	return nil
+}
+
+func (p *Peer) HandleEvent(m Message) error {
+	event, ok := m.Body.Content.(UserEvent)
+	if !ok {
+		return p.malformed(m)
+	}
+	if !p.parentCluster.ReceiveEvent(event) {
+		return nil
+	}
+	return p.SpreadEvent(event)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReceiveEvent(t *testing.T) {
+	C := Cluster{SeenEvents: make(map[string]bool), EventHandlers: make(map[string][]EventHandler), EventsMutex: new(sync.Mutex), MaxEvents: 2}
+	delivered := 0
+	C.SubscribeEvent("deploy", func(Event UserEvent) {
+		delivered++
+	})
+	if !C.ReceiveEvent(UserEvent{ID: "1", Name: "deploy", LTime: 5}) {
+		t.Error(errors.New("New event was not accepted"))
+	}
+	if C.ReceiveEvent(UserEvent{ID: "1", Name: "deploy", LTime: 5}) {
+		t.Error(errors.New("Duplicate event was accepted"))
+	}
+	if C.EventClock != 6 {
+		t.Error(errors.New("Lamport time was not witnessed"))
+	}
+	C.ReceiveEvent(UserEvent{ID: "2", Name: "other", LTime: 7})
+	C.ReceiveEvent(UserEvent{ID: "3", Name: "deploy", LTime: 8})
+	if len(C.RecentEvents) != 2 || C.RecentEvents[0].ID != "2" {
+		t.Error(errors.New("Recent events were not bounded"))
+	}
+	if C.ReceiveEvent(UserEvent{ID: "4", Name: "deploy", LTime: 1}) {
+		t.Error(errors.New("Event older than the buffer was accepted"))
+	}
+	if delivered != 2 {
+		t.Error(errors.New("Subscribers did not receive events by name"))
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	received := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		C, _ := S.AddNode()
+		C.SubscribeEvent("deploy", func(Event UserEvent) {
+			received[C.LocalPeer.ID]++
+		})
+	}
+	S.Run(time.Second * 5)
+	S.Faults.SetConfig(FaultConfig{Loss: 0.2, Duplicate: 0.2})
+	err := S.Clusters[0].Broadcast("deploy", []byte("v2"))
+	if err != nil {
+		t.Error(err)
+	}
+	S.Run(time.Second * 10)
+	for _, C := range S.Clusters {
+		if received[C.LocalPeer.ID] != 1 {
+			t.Error(errors.New("Event was not delivered exactly once"))
+		}
+	}
+	S.Shutdown()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type FaultConfig struct {
+	//Probabilities between 0 and 1 applied to each packet
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+	//Delay applied to each packet, streams only see the latency
+	Latency time.Duration
+	Jitter  time.Duration
+}
+
+// FaultInjector holds the faults shared by every transport it wraps so
+// partitions apply across the whole network
+type FaultInjector struct {
+	Config     FaultConfig
+	Clock      Clock
+	Partitions map[string][2]map[string]bool
+	rand       *rand.Rand
+	Mutex      *sync.Mutex
+}
+
+type FaultTransport struct {
+	Transport Transport
+	Address   string
+	injector  *FaultInjector
+}
+
+func NewFaultInjector(Seed int64, Config FaultConfig) *FaultInjector {
+	return &FaultInjector{Config: Config, Clock: RealClock{}, Partitions: make(map[string][2]map[string]bool), rand: rand.New(rand.NewSource(Seed)), Mutex: new(sync.Mutex)}
+}
+
+func (f *FaultInjector) Wrap(t Transport) *FaultTransport {
+	return &FaultTransport{Transport: t, injector: f}
+}
+
+func (f *FaultInjector) SetConfig(Config FaultConfig) {
+	f.Mutex.Lock()
+	f.Config = Config
+	f.Mutex.Unlock()
+}
+
+// Partition blocks all traffic between the two sets of addresses until healed
+func (f *FaultInjector) Partition(Name string, Side, OtherSide []string) {
+	sides := [2]map[string]bool{make(map[string]bool), make(map[string]bool)}
+	for _, address := range Side {
+		sides[0][address] = true
+	}
+	for _, address := range OtherSide {
+		sides[1][address] = true
+	}
+	f.Mutex.Lock()
+	f.Partitions[Name] = sides
+	f.Mutex.Unlock()
+}
+
+func (f *FaultInjector) Heal(Name string) {
+	f.Mutex.Lock()
+	delete(f.Partitions, Name)
+	f.Mutex.Unlock()
+}
+
+func (f *FaultInjector) partitioned(From, To string) bool {
+	for _, sides := range f.Partitions {
+		if (sides[0][From] && sides[1][To]) || (sides[1][From] && sides[0][To]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FaultInjector) delay() time.Duration {
+	delay := f.Config.Latency
+	if f.Config.Jitter > 0 {
+		delay += time.Duration(f.rand.Int63n(int64(f.Config.Jitter)))
+	}
+	return delay
+}
+
+func (t *FaultTransport) Listen(IP string, Port int, Packets PacketHandler, Streams StreamHandler) error {
+	t.Address = net.JoinHostPort(IP, strconv.Itoa(Port))
+	return t.Transport.Listen(IP, Port, Packets, Streams)
+}
+
+func (t *FaultTransport) WritePacket(Address string, Packet []byte) error {
+	f := t.injector
+	//Decide every fault up front so the random sequence only depends on the seed
+	f.Mutex.Lock()
+	if f.partitioned(t.Address, Address) || f.rand.Float64() < f.Config.Loss {
+		f.Mutex.Unlock()
+		return nil
+	}
+	copies := 1
+	if f.rand.Float64() < f.Config.Duplicate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = f.delay()
+		//Hold reordered packets back long enough for later packets to overtake them
+		if f.rand.Float64() < f.Config.Reorder {
+			delays[i] += f.Config.Latency + f.Config.Jitter + time.Millisecond
+		}
+	}
+	f.Mutex.Unlock()
+
+	packet := append([]byte(nil), Packet...)
+	for _, delay := range delays {
+		if delay == 0 {
+			err := t.Transport.WritePacket(Address, packet)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		f.Clock.AfterFunc(delay, func() {
+			t.Transport.WritePacket(Address, packet)
+		})
+	}
+	return nil
+}
+
+func (t *FaultTransport) WriteStream(Address string, Message []byte) error {
+	f := t.injector
+	f.Mutex.Lock()
+	partitioned := f.partitioned(t.Address, Address)
+	//Streams are ordered so they only see the fixed latency, never jitter
+	delay := f.Config.Latency
+	f.Mutex.Unlock()
+	if partitioned {
+		return errors.New("Network partitioned")
+	}
+	if delay == 0 {
+		return t.Transport.WriteStream(Address, Message)
+	}
+	message := append([]byte(nil), Message...)
+	f.Clock.AfterFunc(delay, func() {
+		t.Transport.WriteStream(Address, message)
+	})
+	return nil
+}
+
+func (t *FaultTransport) Close() error {
+	return t.Transport.Close()
+}
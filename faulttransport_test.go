@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func deliveredPackets(Seed int64, Config FaultConfig) int {
+	network := NewMemoryNetwork()
+	injector := NewFaultInjector(Seed, Config)
+	delivered := 0
+	T := injector.Wrap(network.NewTransport())
+	T.Listen("127.0.0.1", 1, func(Address string, Packet []byte) {
+		delivered++
+	}, func(Address string, Message []byte) {})
+	T2 := injector.Wrap(network.NewTransport())
+	T2.Listen("127.0.0.1", 2, func(Address string, Packet []byte) {}, func(Address string, Message []byte) {})
+	for i := 0; i < 1000; i++ {
+		T2.WritePacket("127.0.0.1:1", []byte("Hello"))
+	}
+	return delivered
+}
+
+func TestFaultInjection(t *testing.T) {
+	delivered := deliveredPackets(1, FaultConfig{Loss: 0.3})
+	if delivered < 600 || delivered > 800 {
+		t.Error(errors.New("Packet loss was not applied"))
+	}
+	if deliveredPackets(1, FaultConfig{Loss: 0.3}) != delivered {
+		t.Error(errors.New("Same seed did not reproduce the same losses"))
+	}
+	if deliveredPackets(1, FaultConfig{Duplicate: 1}) != 2000 {
+		t.Error(errors.New("Packets were not duplicated"))
+	}
+}
+
+func TestFaultPartition(t *testing.T) {
+	network := NewMemoryNetwork()
+	injector := NewFaultInjector(1, FaultConfig{})
+	packets := make(chan []byte, 1)
+	T := injector.Wrap(network.NewTransport())
+	T.Listen("127.0.0.1", 1, func(Address string, Packet []byte) {
+		packets <- Packet
+	}, func(Address string, Message []byte) {})
+	T2 := injector.Wrap(network.NewTransport())
+	T2.Listen("127.0.0.1", 2, func(Address string, Packet []byte) {}, func(Address string, Message []byte) {})
+
+	injector.Partition("split", []string{"127.0.0.1:1"}, []string{"127.0.0.1:2"})
+	T2.WritePacket("127.0.0.1:1", []byte("Hello"))
+	if len(packets) != 0 {
+		t.Error(errors.New("Packet crossed a partition"))
+	}
+	if T2.WriteStream("127.0.0.1:1", []byte("Hello")) == nil {
+		t.Error(errors.New("Stream crossed a partition"))
+	}
+	injector.Heal("split")
+	T2.WritePacket("127.0.0.1:1", []byte("Hello"))
+	if len(packets) != 1 {
+		t.Error(errors.New("Packet was not delivered after healing"))
+	}
+}
+
+func TestGossipUnderFaults(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 4; i++ {
+		S.AddNode()
+	}
+	S.Run(time.Second * 2)
+	addresses := make([]string, 0)
+	for _, C := range S.Clusters {
+		addresses = append(addresses, C.LocalPeer.Address())
+	}
+
+	//Isolate the first node while it writes a value
+	S.Faults.SetConfig(FaultConfig{Loss: 0.2, Duplicate: 0.1, Reorder: 0.1, Latency: time.Millisecond * 5, Jitter: time.Millisecond * 5})
+	S.Faults.Partition("isolate", addresses[:1], addresses[1:])
+	S.Clusters[0].SetValue("key", map[string]interface{}{"a": "b"}, 0)
+	S.Run(time.Second * 2)
+	for _, C := range S.Clusters[1:] {
+		C.ValuesMutex.RLock()
+		if C.Values["key"] != nil {
+			t.Error(errors.New("Value crossed a partition"))
+		}
+		C.ValuesMutex.RUnlock()
+	}
+
+	S.Faults.Heal("isolate")
+	converged := false
+	for i := 0; i < 20 && !converged; i++ {
+		S.Run(time.Second)
+		converged = true
+		for _, C := range S.Clusters {
+			C.ValuesMutex.RLock()
+			if C.Values["key"] == nil {
+				converged = false
+			}
+			C.ValuesMutex.RUnlock()
+		}
+	}
+	if !converged {
+		t.Error(errors.New("Gossip did not converge after healing"))
+	}
+	S.Shutdown()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	packetMessage  = byte(0)
+	packetFragment = byte(1)
+	//Type byte, fragment ID, index and total
+	fragmentHeaderSize = 1 + 8 + 2 + 2
+	maxFragments       = 65535
+	//Memory a partial message holds for each fragment slot before it arrives
+	fragmentSlotSize = 24
+)
+
+type PartialMessage struct {
+	Fragments [][]byte
+	Received  int
+	Bytes     int
+	//Memory held by the fragment slots themselves
+	Overhead int
+	Started  time.Time
+}
+
+type SenderReassembly struct {
+	Bytes    int
+	Partials map[uint64]*PartialMessage
+}
+
+// FragmentMessage splits an encoded message into datagrams no larger than the MTU
+func (c *Cluster) FragmentMessage(messageBytes []byte) ([][]byte, error) {
+	if len(messageBytes)+1 <= c.MTU {
+		return [][]byte{append([]byte{packetMessage}, messageBytes...)}, nil
+	}
+	if len(messageBytes) > c.MaxMessageSize {
+		return nil, errors.New("Message exceeds maximum message size")
+	}
+	chunkSize := c.MTU - fragmentHeaderSize
+	if chunkSize <= 0 {
+		return nil, errors.New("MTU is too small to fragment messages")
+	}
+	total := (len(messageBytes) + chunkSize - 1) / chunkSize
+	if total > maxFragments {
+		return nil, errors.New("Message requires too many fragments")
+	}
+	id := atomic.AddUint64(&c.fragmentCounter, 1)
+	packets := make([][]byte, 0, total)
+	for index := 0; index < total; index++ {
+		end := (index + 1) * chunkSize
+		if end > len(messageBytes) {
+			end = len(messageBytes)
+		}
+		packet := make([]byte, fragmentHeaderSize, fragmentHeaderSize+end-index*chunkSize)
+		packet[0] = packetFragment
+		binary.BigEndian.PutUint64(packet[1:9], id)
+		binary.BigEndian.PutUint16(packet[9:11], uint16(index))
+		binary.BigEndian.PutUint16(packet[11:13], uint16(total))
+		packets = append(packets, append(packet, messageBytes[index*chunkSize:end]...))
+	}
+	return packets, nil
+}
+
+// ReassemblePacket returns the complete message carried by a datagram, or nil
+// while fragments of the message are still outstanding
+func (c *Cluster) ReassemblePacket(Address string, packet []byte) ([]byte, error) {
+	if len(packet) == 0 {
+		return nil, errors.New("Empty packet")
+	}
+	switch packet[0] {
+	case packetMessage:
+		return packet[1:], nil
+	case packetFragment:
+	default:
+		return nil, errors.New("Unknown packet type")
+	}
+	if len(packet) <= fragmentHeaderSize {
+		return nil, errors.New("Truncated fragment")
+	}
+	id := binary.BigEndian.Uint64(packet[1:9])
+	index := int(binary.BigEndian.Uint16(packet[9:11]))
+	total := int(binary.BigEndian.Uint16(packet[11:13]))
+	data := packet[fragmentHeaderSize:]
+	if total < 2 || index >= total {
+		return nil, errors.New("Invalid fragment index")
+	}
+	//No honest sender splits a message into more fragments than this
+	chunkSize := c.MTU - fragmentHeaderSize
+	if chunkSize <= 0 || total > (c.MaxMessageSize+chunkSize-1)/chunkSize {
+		return nil, errors.New("Fragment total exceeds maximum message size")
+	}
+
+	c.ReassemblyMutex.Lock()
+	defer c.ReassemblyMutex.Unlock()
+	sender := c.Reassembly[Address]
+	if sender == nil {
+		sender = &SenderReassembly{Partials: make(map[uint64]*PartialMessage)}
+		c.Reassembly[Address] = sender
+	}
+	c.expireSenderFragments(sender)
+	partial := sender.Partials[id]
+	if partial == nil {
+		if len(sender.Partials) >= c.MaxPartialMessages {
+			return nil, errors.New("Too many partial messages from sender")
+		}
+		overhead := total * fragmentSlotSize
+		if sender.Bytes+overhead > c.MaxReassemblyBytes {
+			return nil, errors.New("Reassembly memory limit exceeded")
+		}
+		partial = &PartialMessage{Fragments: make([][]byte, total), Overhead: overhead, Started: c.Clock.Now()}
+		sender.Partials[id] = partial
+		sender.Bytes += overhead
+	}
+	if len(partial.Fragments) != total {
+		return nil, errors.New("Fragment total does not match")
+	}
+	if partial.Fragments[index] != nil {
+		//Duplicate fragment
+		return nil, nil
+	}
+	//Drop the whole message rather than let one sender exhaust memory
+	if sender.Bytes+len(data) > c.MaxReassemblyBytes || partial.Bytes+len(data) > c.MaxMessageSize {
+		sender.drop(id)
+		return nil, errors.New("Reassembly memory limit exceeded")
+	}
+	partial.Fragments[index] = append([]byte(nil), data...)
+	partial.Received++
+	partial.Bytes += len(data)
+	sender.Bytes += len(data)
+	if partial.Received < total {
+		return nil, nil
+	}
+
+	message := make([]byte, 0, partial.Bytes)
+	for _, fragment := range partial.Fragments {
+		message = append(message, fragment...)
+	}
+	sender.drop(id)
+	if len(sender.Partials) == 0 {
+		delete(c.Reassembly, Address)
+	}
+	return message, nil
+}
+
+// drop forgets a partial message and releases the memory counted for it
+func (s *SenderReassembly) drop(ID uint64) {
+	partial := s.Partials[ID]
+	s.Bytes -= partial.Bytes + partial.Overhead
+	delete(s.Partials, ID)
+}
+
+func (c *Cluster) expireSenderFragments(sender *SenderReassembly) {
+	for id, partial := range sender.Partials {
+		if c.Clock.Now().Sub(partial.Started) > c.ReassemblyTimeout {
+			sender.drop(id)
+		}
+	}
+}
+
+// ExpireFragments drops partially received messages older than the reassembly timeout
+func (c *Cluster) ExpireFragments() error {
+	c.ReassemblyMutex.Lock()
+	for address, sender := range c.Reassembly {
+		c.expireSenderFragments(sender)
+		if len(sender.Partials) == 0 {
+			delete(c.Reassembly, address)
+		}
+	}
+	c.ReassemblyMutex.Unlock()
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newFragmentCluster() *Cluster {
+	return &Cluster{MTU: 1400, MaxMessageSize: 1 << 20, MaxReassemblyBytes: 64 << 10, MaxPartialMessages: 4, ReassemblyTimeout: time.Second, Reassembly: make(map[string]*SenderReassembly), ReassemblyMutex: new(sync.Mutex), Clock: RealClock{}}
+}
+
+func TestFragmentMessage(t *testing.T) {
+	C := newFragmentCluster()
+	message := make([]byte, 10000)
+	rand.Read(message)
+	packets, err := C.FragmentMessage(message)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(packets) < 2 {
+		t.Error(errors.New("Message was not fragmented"))
+	}
+	//Deliver in reverse order with a duplicate
+	var reassembled []byte
+	for i := len(packets) - 1; i >= 0; i-- {
+		result, err := C.ReassemblePacket("127.0.0.1:1", packets[i])
+		if err != nil {
+			t.Error(err)
+		}
+		if result != nil {
+			reassembled = result
+		}
+		if i == len(packets)-1 {
+			C.ReassemblePacket("127.0.0.1:1", packets[i])
+		}
+		if len(packets[i]) > C.MTU {
+			t.Error(errors.New("Packet exceeds MTU"))
+		}
+	}
+	if !bytes.Equal(reassembled, message) {
+		t.Error(errors.New("Message did not reassemble properly"))
+	}
+
+	small, _ := C.FragmentMessage([]byte("Hello"))
+	result, err := C.ReassemblePacket("127.0.0.1:1", small[0])
+	if err != nil || string(result) != "Hello" {
+		t.Error(errors.New("Unfragmented message did not pass through"))
+	}
+}
+
+func TestReassemblyLimits(t *testing.T) {
+	C := newFragmentCluster()
+	message := make([]byte, 128<<10)
+	packets, _ := C.FragmentMessage(message)
+	var err error
+	for _, packet := range packets {
+		_, err = C.ReassemblePacket("127.0.0.1:1", packet)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		t.Error(errors.New("Reassembly memory limit was not enforced"))
+	}
+
+	//A forged fragment total can not reserve more slots than a real message needs
+	forged := make([]byte, fragmentHeaderSize+1)
+	forged[0] = packetFragment
+	binary.BigEndian.PutUint16(forged[11:13], maxFragments)
+	C = newFragmentCluster()
+	if _, err := C.ReassemblePacket("127.0.0.1:1", forged); err == nil {
+		t.Error(errors.New("Fragment total over the message size limit was accepted"))
+	}
+	//Each sender may only have a few messages in flight
+	for id := uint64(1); id <= 5; id++ {
+		binary.BigEndian.PutUint64(forged[1:9], id)
+		binary.BigEndian.PutUint16(forged[11:13], 2)
+		_, err = C.ReassemblePacket("127.0.0.1:1", forged)
+	}
+	if err == nil || len(C.Reassembly["127.0.0.1:1"].Partials) != 4 {
+		t.Error(errors.New("Partial message limit was not enforced"))
+	}
+	if C.Reassembly["127.0.0.1:1"].Bytes != 4*(1+2*fragmentSlotSize) {
+		t.Error(errors.New("Fragment slots were not counted"))
+	}
+
+	C = newFragmentCluster()
+	C.ReassemblyTimeout = time.Millisecond
+	packets, _ = C.FragmentMessage(make([]byte, 5000))
+	C.ReassemblePacket("127.0.0.1:1", packets[0])
+	time.Sleep(time.Millisecond * 5)
+	C.ExpireFragments()
+	if len(C.Reassembly) != 0 {
+		t.Error(errors.New("Expired fragments were not dropped"))
+	}
+}
+
+func TestSendLargeMessage(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(2048)
+	RSA.GenerateKey()
+	network := NewMemoryNetwork()
+	C := Cluster{Transport: network.NewTransport()}
+	C.Start("127.0.0.1", 8080, RSA.Key, 1)
+	C2 := Cluster{Transport: network.NewTransport()}
+	C2.Bootstrap("127.0.0.1", "127.0.0.1", 8082, 8080, RSA.Key, 1)
+	received := make(chan []byte, 1)
+	C2.RegisterHandler("large", func(From string, Payload []byte) {
+		received <- Payload
+	})
+	waitForPeer(&C, C2.LocalPeer.ID)
+	waitForPeer(&C2, C.LocalPeer.ID)
+	payload := make([]byte, 50000)
+	rand.Read(payload)
+	err := C.Send(C2.LocalPeer.ID, "large", payload)
+	if err != nil {
+		t.Error(err)
+	}
+	select {
+	case result := <-received:
+		if !bytes.Equal(result, payload) {
+			t.Error(errors.New("Payload did not arrive intact"))
+		}
+	case <-time.After(time.Second * 2):
+		t.Error(errors.New("Message was not delivered"))
+	}
+	C.Shutdown()
+	C2.Shutdown()
+}
@@ -1,5 +1,7 @@
 module github.com/ConnorJarvis/P2P-Communication
 
+go 1.20
+
 require (
 	github.com/ConnorJarvis/FileTransfer v0.0.0-20190320001450-f78e6011e29f
 	github.com/davecgh/go-spew v1.1.1
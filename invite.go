@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// InviteToken lets a new node join without a copy of the cluster key. It is
+// redeemed once at the member that minted it, which holds the matching Invite
+type InviteToken struct {
+	ID        string
+	Issuer    string
+	IssuerKey []byte
+	Suite     string
+	Seeds     []string
+	Expires   int64
+	Secret    []byte
+	Signature []byte
+}
+
+// Invite is the minting member's record of an outstanding invite
+type Invite struct {
+	Secret  []byte
+	Expires time.Time
+	Used    bool
+}
+
+// CreateInvite mints a signed, single-use invite valid for the duration
+func (c *Cluster) CreateInvite(ValidFor time.Duration) (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	secret, err := GenerateAESKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	expires := c.Clock.Now().Add(ValidFor)
+	token := InviteToken{ID: id.String(), Issuer: c.LocalPeer.ID, IssuerKey: c.LocalPeer.PublicKey, Suite: c.Suite.Name(), Seeds: []string{c.LocalPeer.Address()}, Expires: expires.UnixNano(), Secret: secret}
+	signed, err := token.signedBytes()
+	if err != nil {
+		return "", err
+	}
+	token.Signature, err = c.Suite.Sign(c.LocalPeer.identity, signed)
+	if err != nil {
+		return "", err
+	}
+	tokenBytes := bytes.Buffer{}
+	err = gob.NewEncoder(&tokenBytes).Encode(token)
+	if err != nil {
+		return "", err
+	}
+	c.InvitesMutex.Lock()
+	c.Invites[token.ID] = &Invite{Secret: secret, Expires: expires}
+	c.InvitesMutex.Unlock()
+	return base64.RawURLEncoding.EncodeToString(tokenBytes.Bytes()), nil
+}
+
+func (t InviteToken) signedBytes() ([]byte, error) {
+	t.Signature = nil
+	tokenBytes := bytes.Buffer{}
+	err := gob.NewEncoder(&tokenBytes).Encode(t)
+	return tokenBytes.Bytes(), err
+}
+
+// ParseInviteToken decodes a token and checks the issuer's signature on it
+func ParseInviteToken(Token string) (*InviteToken, error) {
+	tokenBytes, err := base64.RawURLEncoding.DecodeString(Token)
+	if err != nil {
+		return nil, err
+	}
+	token := &InviteToken{}
+	err = gob.NewDecoder(bytes.NewReader(tokenBytes)).Decode(token)
+	if err != nil {
+		return nil, err
+	}
+	suite := SuiteByName(token.Suite)
+	if suite == nil {
+		return nil, errors.New("Unknown suite " + token.Suite)
+	}
+	signed, err := token.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	err = suite.Verify(token.IssuerKey, signed, token.Signature)
+	if err != nil {
+		return nil, errors.New("Invalid invite signature")
+	}
+	return token, nil
+}
+
+// SuiteByName returns the suite peers announce with the name, or nil
+func SuiteByName(Name string) Suite {
+	switch Name {
+	case RSASuite{}.Name():
+		return RSASuite{Length: 2048}
+	case Ed25519Suite{}.Name():
+		return Ed25519Suite{}
+	}
+	return nil
+}
+
+// BootstrapWithInvite joins the cluster with an invite token in place of the
+// cluster key. The node never receives the cluster key, so it can not admit
+// peers with it or hand it on
+func (c *Cluster) BootstrapWithInvite(LocalIP string, LocalPort int, Token string, MaxConnections int) error {
+	token, err := ParseInviteToken(Token)
+	if err != nil {
+		return err
+	}
+	if c.Suite == nil {
+		c.Suite = SuiteByName(token.Suite)
+		if token.Suite == (RSASuite{}).Name() && c.IdentityKeyLength != 0 {
+			c.Suite = RSASuite{Length: c.IdentityKeyLength}
+		}
+	}
+	if c.Suite.Name() != token.Suite {
+		return errors.New("Invite is for the " + token.Suite + " suite")
+	}
+	if c.Clock == nil {
+		c.Clock = RealClock{}
+	}
+	if c.Clock.Now().UnixNano() > token.Expires {
+		return errors.New("Invite has expired")
+	}
+	seeds := make([]Peer, 0, len(token.Seeds))
+	for _, seed := range token.Seeds {
+		host, port, err := net.SplitHostPort(seed)
+		if err != nil {
+			return err
+		}
+		portNumber, err := strconv.Atoi(port)
+		if err != nil {
+			return err
+		}
+		seeds = append(seeds, Peer{IP: host, Port: portNumber})
+	}
+	//The keyring stays empty
+	err = c.Start(LocalIP, LocalPort, rsa.PrivateKey{}, MaxConnections)
+	if err != nil {
+		return err
+	}
+	c.InvitesMutex.Lock()
+	c.JoinInvite = token
+	c.InvitesMutex.Unlock()
+	M := Message{Header: Header{ID: 0, From: c.LocalPeer.ID}, Body: Body{Content: Peer{IP: LocalIP, Port: LocalPort, ID: c.LocalPeer.ID, Tags: c.Tags, Suite: c.LocalPeer.Suite, PublicKey: c.LocalPeer.PublicKey, Certificate: c.Certificate}}}
+	messageBytes, err := c.LocalPeer.EncodeInviteMessage(token.ID, token.Secret, "join", M)
+	if err == nil {
+		for _, seed := range seeds {
+			err = c.LocalPeer.WritePacket(seed, messageBytes)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		c.Shutdown()
+		return err
+	}
+	return nil
+}
+
+// EncodeInviteMessage encrypts with a key derived from the invite secret, one
+// key for each direction
+func (p *Peer) EncodeInviteMessage(ID string, Secret []byte, Direction string, m Message) ([]byte, error) {
+	p.parentCluster.StampHeader(&m.Header)
+	messageBytes, err := m.Encode()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := GenerateAESNonce(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := Encrypt(messageBytes, deriveKey(Secret, []byte(ID), "invite "+Direction), nonce)
+	if err != nil {
+		return nil, err
+	}
+	encryptedMessage := EncryptedMessage{Message: ciphertext, Nonce: nonce, Invite: ID}
+	return encryptedMessage.Encode()
+}
+
+// OpenInviteMessage decrypts a join request at the member that minted the
+// invite, or the reply at the joining node
+func (c *Cluster) OpenInviteMessage(m EncryptedMessage) (*Message, error) {
+	c.InvitesMutex.Lock()
+	defer c.InvitesMutex.Unlock()
+	if invite := c.Invites[m.Invite]; invite != nil {
+		if invite.Used || c.Clock.Now().After(invite.Expires) {
+			return nil, errors.New("Invite has been used or has expired")
+		}
+		decryptedMessage, err := decryptInviteMessage(m, invite.Secret, "join")
+		if err != nil {
+			return nil, err
+		}
+		if decryptedMessage.Header.ID != 0 {
+			return nil, errors.New("Message type not allowed with an invite")
+		}
+		return decryptedMessage, nil
+	}
+	if c.JoinInvite != nil && c.JoinInvite.ID == m.Invite {
+		decryptedMessage, err := decryptInviteMessage(m, c.JoinInvite.Secret, "reply")
+		if err != nil {
+			return nil, err
+		}
+		if decryptedMessage.Header.ID != 1 || decryptedMessage.Header.From != c.JoinInvite.Issuer {
+			return nil, errors.New("Message type not allowed with an invite")
+		}
+		//The reply is only accepted once
+		c.JoinInvite = nil
+		return decryptedMessage, nil
+	}
+	return nil, errors.New("Unknown invite")
+}
+
+func decryptInviteMessage(m EncryptedMessage, Secret []byte, Direction string) (*Message, error) {
+	plaintext, err := Decrypt(m.Message, deriveKey(Secret, []byte(m.Invite), "invite "+Direction), m.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	decryptedMessage := &Message{}
+	err = gob.NewDecoder(bytes.NewReader(plaintext)).Decode(decryptedMessage)
+	if err != nil {
+		return nil, err
+	}
+	return decryptedMessage, nil
+}
+
+// ExpireInvites forgets expired invites. Used ones are kept until then so a
+// second attempt to redeem them is still refused
+func (c *Cluster) ExpireInvites() {
+	now := c.Clock.Now()
+	c.InvitesMutex.Lock()
+	defer c.InvitesMutex.Unlock()
+	for id, invite := range c.Invites {
+		if now.After(invite.Expires) {
+			delete(c.Invites, id)
+		}
+	}
+	if c.JoinInvite != nil && now.UnixNano() > c.JoinInvite.Expires {
+		c.JoinInvite = nil
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestInvite(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	S.AddNode()
+	S.AddNode()
+	S.Run(time.Second * 2)
+	C := S.Clusters[1]
+
+	token, err := C.CreateInvite(time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	invited := func(Token string) *Cluster {
+		index := len(S.Clusters)
+		c := &Cluster{Transport: S.Faults.Wrap(S.Network.NewTransport()), Clock: S.Clock, Random: rand.New(rand.NewSource(int64(index))), NodeID: fmt.Sprintf("node-%06d", index), Synchronous: true, IdentityKeyLength: 1024}
+		err := c.BootstrapWithInvite(S.Address(index), 1, Token, 1)
+		if err != nil {
+			t.Error(err)
+		}
+		S.Clusters = append(S.Clusters, c)
+		return c
+	}
+	joined := invited(token)
+	S.Run(time.Second * 5)
+	//Gossip keeps the keyring sealed for cluster keys the invited peer lacks
+	if len(joined.KeyList()) != 0 {
+		t.Error(errors.New("Invited peer should not receive the keyring"))
+	}
+	for _, c := range S.Clusters {
+		if c.Peers[joined.LocalPeer.ID] == nil {
+			t.Error(errors.New("Invited peer did not join"))
+		}
+	}
+
+	//Each invite admits a single node
+	reused := invited(token)
+	S.Run(time.Second * 5)
+	if C.Peers[reused.LocalPeer.ID] != nil || reused.Peers[C.LocalPeer.ID] != nil {
+		t.Error(errors.New("Invite should only be used once"))
+	}
+
+	//A failed admission does not use the invite up
+	token, err = C.CreateInvite(time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	imposter := &Cluster{Transport: S.Faults.Wrap(S.Network.NewTransport()), Clock: S.Clock, NodeID: S.Clusters[0].LocalPeer.ID, Synchronous: true, IdentityKeyLength: 1024}
+	err = imposter.BootstrapWithInvite(S.Address(len(S.Clusters)+10), 1, token, 1)
+	if err != nil {
+		t.Error(err)
+	}
+	S.Run(time.Second * 5)
+	if imposter.Peers[C.LocalPeer.ID] != nil {
+		t.Error(errors.New("Peer taking over an ID should not be admitted"))
+	}
+	retried := invited(token)
+	S.Run(time.Second * 5)
+	if C.Peers[retried.LocalPeer.ID] == nil {
+		t.Error(errors.New("Invite should survive a failed admission"))
+	}
+	imposter.Shutdown()
+
+	token, err = C.CreateInvite(time.Second)
+	if err != nil {
+		t.Error(err)
+	}
+	S.Run(time.Second * 2)
+	expired := &Cluster{Clock: S.Clock, Transport: S.Faults.Wrap(S.Network.NewTransport()), IdentityKeyLength: 1024}
+	if expired.BootstrapWithInvite(S.Address(len(S.Clusters)), 1, token, 1) == nil {
+		t.Error(errors.New("Expired invite should be refused"))
+	}
+	if expired.LocalPeer.parentCluster != nil {
+		t.Error(errors.New("Expired invite should not start the node"))
+	}
+
+	//Tokens are signed by the member that minted them
+	tampered := []byte(token)
+	tampered[len(tampered)/2] ^= 1
+	if _, err := ParseInviteToken(string(tampered)); err == nil {
+		t.Error(errors.New("Tampered invite should be refused"))
+	}
+	S.Shutdown()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io/ioutil"
+)
+
+// Iterations of PBKDF2 used when encrypting a private key with a passphrase
+const keyFileIterations = 600000
+
+// Most PBKDF2 iterations accepted when decrypting, so a crafted key file can
+// not stall the process
+const maxKeyFileIterations = 10000000
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// PKCS#8 EncryptedPrivateKeyInfo with PBES2, as written by openssl pkcs8
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	PRF            pkix.AlgorithmIdentifier
+}
+
+// KeyFingerprint identifies a public key by the SHA-256 of its PKIX encoding,
+// matching openssl's digest of the DER public key
+func KeyFingerprint(Key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(Key)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:])
+}
+
+// EncodePrivateKeyPEM encodes a key as PKCS#8 PEM, encrypted with PBES2 when a
+// passphrase is given
+func EncodePrivateKeyPEM(Key crypto.Signer, Passphrase string) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(Key)
+	if err != nil {
+		return nil, err
+	}
+	if Passphrase == "" {
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rand.Read(iv)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pbkdf2(sha256.New, []byte(Passphrase), salt, keyFileIterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	//PKCS#7 padding up to the block size
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	plaintext := append(der, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{Salt: salt, IterationCount: keyFileIterations, PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue}})
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}}, EncryptedData: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encrypted}), nil
+}
+
+// DecodePrivateKeyPEM reads a PKCS#8 or PKCS#1 private key, decrypting it with
+// the passphrase if it is encrypted
+func DecodePrivateKeyPEM(Data []byte, Passphrase string) (crypto.Signer, error) {
+	block, _ := pem.Decode(Data)
+	if block == nil {
+		return nil, errors.New("No PEM block found")
+	}
+	der := block.Bytes
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "ENCRYPTED PRIVATE KEY":
+		if Passphrase == "" {
+			return nil, errors.New("Key is encrypted and no passphrase was given")
+		}
+		var err error
+		der, err = decryptPrivateKey(der, Passphrase)
+		if err != nil {
+			return nil, err
+		}
+	case "PRIVATE KEY":
+	default:
+		return nil, errors.New("Unsupported PEM block " + block.Type)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Key can not sign")
+	}
+	return signer, nil
+}
+
+func decryptPrivateKey(Data []byte, Passphrase string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	_, err := asn1.Unmarshal(Data, &info)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("Unsupported key encryption")
+	}
+	var params pbes2Params
+	_, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) || !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, errors.New("Unsupported key encryption")
+	}
+	var kdfParams pbkdf2Params
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams)
+	if err != nil {
+		return nil, err
+	}
+	if !kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+		return nil, errors.New("Unsupported key derivation")
+	}
+	if kdfParams.IterationCount < 1 || kdfParams.IterationCount > maxKeyFileIterations {
+		return nil, errors.New("Unsupported key derivation iteration count")
+	}
+	var iv []byte
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("Malformed encrypted key")
+	}
+	block, err := aes.NewCipher(pbkdf2(sha256.New, []byte(Passphrase), kdfParams.Salt, kdfParams.IterationCount, 32))
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, info.EncryptedData)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		//Almost always a wrong passphrase
+		return nil, errors.New("Incorrect passphrase")
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// pbkdf2 derives a key from a passphrase as in RFC 8018
+func pbkdf2(Hash func() hash.Hash, Password, Salt []byte, Iterations, Length int) []byte {
+	prf := hmac.New(Hash, Password)
+	key := make([]byte, 0, Length)
+	for block := uint32(1); len(key) < Length; block++ {
+		prf.Reset()
+		prf.Write(Salt)
+		counter := make([]byte, 4)
+		binary.BigEndian.PutUint32(counter, block)
+		prf.Write(counter)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < Iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:Length]
+}
+
+// EncodePublicKeyPEM encodes a public key as a PKIX PEM block
+func EncodePublicKeyPEM(Key crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(Key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func DecodePublicKeyPEM(Data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(Data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("No public key PEM block found")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// SavePrivateKey writes a key to a file only the owner can read
+func SavePrivateKey(Path string, Key crypto.Signer, Passphrase string) error {
+	data, err := EncodePrivateKeyPEM(Key, Passphrase)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(Path, data, 0600)
+}
+
+func LoadPrivateKey(Path, Passphrase string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(Path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePrivateKeyPEM(data, Passphrase)
+}
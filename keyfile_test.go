@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	//Test vector from RFC 7914
+	key := pbkdf2(sha256.New, []byte("passwd"), []byte("salt"), 1, 64)
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if hex.EncodeToString(key) != expected {
+		t.Error(errors.New("Derived key does not match the test vector"))
+	}
+}
+
+func TestPrivateKeyPEM(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	_, edKey, _ := ed25519.GenerateKey(nil)
+	for _, passphrase := range []string{"", "correct horse"} {
+		data, err := EncodePrivateKeyPEM(&RSA.Key, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := DecodePrivateKeyPEM(data, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !key.(*rsa.PrivateKey).Equal(&RSA.Key) {
+			t.Error(errors.New("RSA key did not survive encoding"))
+		}
+		data, _ = EncodePrivateKeyPEM(edKey, passphrase)
+		key, err = DecodePrivateKeyPEM(data, passphrase)
+		if err != nil || !reflect.DeepEqual(key, edKey) {
+			t.Error(errors.New("Ed25519 key did not survive encoding"))
+		}
+	}
+	data, _ := EncodePrivateKeyPEM(edKey, "correct horse")
+	if _, err := DecodePrivateKeyPEM(data, "wrong"); err == nil {
+		t.Error(errors.New("Wrong passphrase should fail"))
+	}
+	if _, err := DecodePrivateKeyPEM(data, ""); err == nil {
+		t.Error(errors.New("Encrypted key should need a passphrase"))
+	}
+
+	//A crafted key file must not make the reader run PBKDF2 for hours
+	block, _ := pem.Decode(data)
+	var info encryptedPrivateKeyInfo
+	var params pbes2Params
+	var kdfParams pbkdf2Params
+	asn1.Unmarshal(block.Bytes, &info)
+	asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+	asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams)
+	kdfParams.IterationCount = 1 << 30
+	params.KeyDerivationFunc.Parameters.FullBytes, _ = asn1.Marshal(kdfParams)
+	info.Algorithm.Parameters.FullBytes, _ = asn1.Marshal(params)
+	block.Bytes, _ = asn1.Marshal(info)
+	if _, err := DecodePrivateKeyPEM(pem.EncodeToMemory(block), "correct horse"); err == nil {
+		t.Error(errors.New("Implausible iteration count should be rejected"))
+	}
+
+	publicData, err := EncodePublicKeyPEM(edKey.Public())
+	if err != nil {
+		t.Error(err)
+	}
+	publicKey, err := DecodePublicKeyPEM(publicData)
+	if err != nil || KeyFingerprint(publicKey) != KeyFingerprint(edKey.Public()) {
+		t.Error(errors.New("Public key did not survive encoding"))
+	}
+}
+
+func TestSaveKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	path := filepath.Join(dir, "cluster.pem")
+	err = RSA.SaveKey(path, "secret")
+	if err != nil {
+		t.Error(err)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Error(errors.New("Key file should only be readable by its owner"))
+	}
+	loaded := RSAUtil{}
+	err = loaded.LoadKey(path, "secret")
+	if err != nil {
+		t.Error(err)
+	}
+	if KeyFingerprint(&loaded.Key.PublicKey) != KeyFingerprint(&RSA.Key.PublicKey) {
+		t.Error(errors.New("Loaded key does not match the saved key"))
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+)
+
+// KeyringState is the cluster keyring as gossiped between peers. The keys
+// are sealed for every key in the ring, so only peers already holding a
+// cluster key can read them and peers that joined with an invite never do.
+// The first key is the primary, used to encrypt, and the others are still
+// accepted
+type KeyringState struct {
+	Version uint64
+	//Breaks ties between changes made on different peers at once
+	Origin string
+	//The key the keys are sealed with, encrypted under each cluster key and
+	//indexed by that key's fingerprint
+	Wrapped map[string][]byte
+	Sealed  []byte
+	Nonce   []byte
+}
+
+// KeyList returns the fingerprints of the keyring, primary first
+func (c *Cluster) KeyList() []string {
+	c.KeyringMutex.RLock()
+	defer c.KeyringMutex.RUnlock()
+	fingerprints := make([]string, 0, len(c.Keys))
+	for i := range c.Keys {
+		fingerprints = append(fingerprints, KeyFingerprint(&c.Keys[i].PublicKey))
+	}
+	return fingerprints
+}
+
+// InstallKey adds a key the cluster accepts without yet encrypting with it.
+// Install on every peer before using it so no peer rejects the new key
+func (c *Cluster) InstallKey(Key rsa.PrivateKey) error {
+	fingerprint := KeyFingerprint(&Key.PublicKey)
+	return c.changeKeyring(func(keys []rsa.PrivateKey) ([]rsa.PrivateKey, error) {
+		for i := range keys {
+			if KeyFingerprint(&keys[i].PublicKey) == fingerprint {
+				return nil, errors.New("Key is already installed")
+			}
+		}
+		return append(keys, Key), nil
+	})
+}
+
+// UseKey makes an installed key the primary key across the cluster
+func (c *Cluster) UseKey(Fingerprint string) error {
+	return c.changeKeyring(func(keys []rsa.PrivateKey) ([]rsa.PrivateKey, error) {
+		for i := range keys {
+			if KeyFingerprint(&keys[i].PublicKey) == Fingerprint {
+				keys[0], keys[i] = keys[i], keys[0]
+				return keys, nil
+			}
+		}
+		return nil, errors.New("Key is not installed")
+	})
+}
+
+// RemoveKey stops the cluster accepting a key that is no longer primary
+func (c *Cluster) RemoveKey(Fingerprint string) error {
+	return c.changeKeyring(func(keys []rsa.PrivateKey) ([]rsa.PrivateKey, error) {
+		if KeyFingerprint(&keys[0].PublicKey) == Fingerprint {
+			return nil, errors.New("Can not remove the primary key")
+		}
+		for i := range keys {
+			if KeyFingerprint(&keys[i].PublicKey) == Fingerprint {
+				return append(keys[:i], keys[i+1:]...), nil
+			}
+		}
+		return nil, errors.New("Key is not installed")
+	})
+}
+
+// changeKeyring applies a change locally under a new version, which gossip
+// then carries to the rest of the cluster. Of two changes made at once on
+// different peers only one survives, so make changes from one place
+func (c *Cluster) changeKeyring(Change func([]rsa.PrivateKey) ([]rsa.PrivateKey, error)) error {
+	c.KeyringMutex.Lock()
+	defer c.KeyringMutex.Unlock()
+	keys, err := Change(append([]rsa.PrivateKey(nil), c.Keys...))
+	if err != nil {
+		return err
+	}
+	c.Keys = keys
+	c.KeyringVersion++
+	c.KeyringOrigin = c.LocalPeer.ID
+	c.sealedKeyring = nil
+	return nil
+}
+
+// KeyringState returns the keyring sealed for gossip. Sealing costs an RSA
+// encryption for each key, so the sealed keyring is kept until it changes
+func (c *Cluster) KeyringState() KeyringState {
+	c.KeyringMutex.Lock()
+	defer c.KeyringMutex.Unlock()
+	if len(c.Keys) == 0 {
+		return KeyringState{}
+	}
+	if c.sealedKeyring == nil {
+		state, err := sealKeyring(c.Keys)
+		if err != nil {
+			return KeyringState{}
+		}
+		c.sealedKeyring = &state
+	}
+	state := *c.sealedKeyring
+	state.Version = c.KeyringVersion
+	state.Origin = c.KeyringOrigin
+	return state
+}
+
+func sealKeyring(Keys []rsa.PrivateKey) (KeyringState, error) {
+	state := KeyringState{Wrapped: make(map[string][]byte)}
+	keyBytes := make([][]byte, 0, len(Keys))
+	for i := range Keys {
+		keyBytes = append(keyBytes, x509.MarshalPKCS1PrivateKey(&Keys[i]))
+	}
+	plaintext := bytes.Buffer{}
+	err := gob.NewEncoder(&plaintext).Encode(keyBytes)
+	if err != nil {
+		return state, err
+	}
+	secret, err := GenerateAESKey(rand.Reader)
+	if err != nil {
+		return state, err
+	}
+	state.Nonce, err = GenerateAESNonce(rand.Reader)
+	if err != nil {
+		return state, err
+	}
+	state.Sealed, err = Encrypt(plaintext.Bytes(), secret, state.Nonce)
+	if err != nil {
+		return state, err
+	}
+	for i := range Keys {
+		RSA := RSAUtil{Reader: rand.Reader, Key: Keys[i]}
+		wrapped, err := RSA.Encrypt(secret)
+		if err != nil {
+			return state, err
+		}
+		state.Wrapped[KeyFingerprint(&Keys[i].PublicKey)] = wrapped
+	}
+	return state, nil
+}
+
+// openKeyring reads a sealed keyring with the first local key it was sealed
+// for, returning no keys if it was sealed for none of them
+func openKeyring(State KeyringState, Keys []rsa.PrivateKey) ([]rsa.PrivateKey, error) {
+	for i := range Keys {
+		wrapped, ok := State.Wrapped[KeyFingerprint(&Keys[i].PublicKey)]
+		if !ok {
+			continue
+		}
+		RSA := RSAUtil{Reader: rand.Reader, Key: Keys[i]}
+		secret, err := RSA.Decrypt(wrapped)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := Decrypt(State.Sealed, secret, State.Nonce)
+		if err != nil {
+			return nil, err
+		}
+		keyBytes := make([][]byte, 0)
+		err = gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]rsa.PrivateKey, 0, len(keyBytes))
+		for _, b := range keyBytes {
+			key, err := x509.ParsePKCS1PrivateKey(b)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, *key)
+		}
+		if len(keys) == 0 {
+			return nil, errors.New("Keyring has no keys")
+		}
+		return keys, nil
+	}
+	return nil, nil
+}
+
+// MergeKeyring adopts a gossiped keyring that is newer than the local one
+func (c *Cluster) MergeKeyring(State KeyringState) error {
+	c.KeyringMutex.Lock()
+	defer c.KeyringMutex.Unlock()
+	stale := State.Version < c.KeyringVersion || (State.Version == c.KeyringVersion && State.Origin <= c.KeyringOrigin)
+	if stale {
+		return nil
+	}
+	keys, err := openKeyring(State, c.Keys)
+	//A keyring sealed for keys this peer never held, as for a peer that
+	//joined with an invite, can not be read and is left alone
+	if err != nil || keys == nil {
+		return err
+	}
+	c.Keys = keys
+	c.KeyringVersion = State.Version
+	c.KeyringOrigin = State.Origin
+	c.sealedKeyring = nil
+	return nil
+}
+
+// PrimaryKey returns the key admission messages are encrypted with
+func (c *Cluster) PrimaryKey() (RSAUtil, error) {
+	c.KeyringMutex.RLock()
+	defer c.KeyringMutex.RUnlock()
+	if len(c.Keys) == 0 {
+		return RSAUtil{}, errors.New("Keyring has no keys")
+	}
+	return RSAUtil{Reader: rand.Reader, Key: c.Keys[0]}, nil
+}
+
+// DecryptAdmission tries each key in the keyring, checking the signature with
+// the key that decrypted the message
+func (c *Cluster) DecryptAdmission(m EncryptedMessage) (*Message, error) {
+	c.KeyringMutex.RLock()
+	keys := append([]rsa.PrivateKey(nil), c.Keys...)
+	c.KeyringMutex.RUnlock()
+	for _, key := range keys {
+		RSA := RSAUtil{Reader: rand.Reader, Key: key}
+		decryptedMessage, err := m.Decrypt(RSA)
+		if err != nil {
+			continue
+		}
+		return decryptedMessage, decryptedMessage.VerifyMessage(RSA)
+	}
+	return nil, errors.New("No key in the keyring decrypts the message")
+}
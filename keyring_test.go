@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyRotation(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	NewRSA := RSAUtil{}
+	NewRSA.InitializeReader()
+	NewRSA.SetKeyLength(1024)
+	NewRSA.GenerateKey()
+	oldKey := KeyFingerprint(&RSA.Key.PublicKey)
+	newKey := KeyFingerprint(&NewRSA.Key.PublicKey)
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 3; i++ {
+		S.AddNode()
+	}
+	S.Run(time.Second * 2)
+	C := S.Clusters[1]
+
+	err := C.InstallKey(NewRSA.Key)
+	if err != nil {
+		t.Error(err)
+	}
+	if C.InstallKey(NewRSA.Key) == nil {
+		t.Error(errors.New("Installing a key twice should fail"))
+	}
+	S.Run(time.Second * 5)
+	for _, C := range S.Clusters {
+		if !reflect.DeepEqual(C.KeyList(), []string{oldKey, newKey}) {
+			t.Error(errors.New("Installed key did not spread"))
+		}
+	}
+	if C.RemoveKey(oldKey) == nil {
+		t.Error(errors.New("Removing the primary key should fail"))
+	}
+	C.UseKey(newKey)
+	S.Run(time.Second * 5)
+	C.RemoveKey(oldKey)
+	S.Run(time.Second * 5)
+	for _, C := range S.Clusters {
+		if !reflect.DeepEqual(C.KeyList(), []string{newKey}) {
+			t.Error(errors.New("Rotation did not spread"))
+		}
+	}
+
+	//Only the new key admits new peers
+	S.Key = NewRSA.Key
+	joined, _ := S.AddNode()
+	S.Key = RSA.Key
+	rejected, _ := S.AddNode()
+	S.Run(time.Second * 5)
+	if S.Clusters[0].Peers[joined.LocalPeer.ID] == nil {
+		t.Error(errors.New("Peer with the new key did not join"))
+	}
+	if S.Clusters[0].Peers[rejected.LocalPeer.ID] != nil {
+		t.Error(errors.New("Peer with the removed key should not join"))
+	}
+	S.Shutdown()
+}
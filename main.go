@@ -16,6 +16,15 @@ func init() {
 	gob.Register(map[string]*Peer{})
 	gob.Register(map[string]Value{})
 	gob.Register(Gossip{})
+	gob.Register(DirectMessage{})
+	gob.Register(RPCRequest{})
+	gob.Register(RPCResponse{})
+	gob.Register(UserEvent{})
+	gob.Register(Query{})
+	gob.Register(QueryReply{})
+	gob.Register(TopicMessage{})
+	gob.Register(Handshake{})
+	gob.Register(InviteToken{})
 }
 
 func main() {
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryNetwork connects MemoryTransports in process so clusters can run without sockets
+type MemoryNetwork struct {
+	Transports map[string]*MemoryTransport
+	Mutex      *sync.RWMutex
+	//When Clock is set deliveries are scheduled on it instead of made immediately
+	Clock   Clock
+	Latency time.Duration
+}
+
+type MemoryTransport struct {
+	Address string
+	network *MemoryNetwork
+	packets PacketHandler
+	streams StreamHandler
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{Transports: make(map[string]*MemoryTransport), Mutex: new(sync.RWMutex)}
+}
+
+func (n *MemoryNetwork) NewTransport() *MemoryTransport {
+	return &MemoryTransport{network: n}
+}
+
+func (n *MemoryNetwork) transport(Address string) *MemoryTransport {
+	n.Mutex.RLock()
+	defer n.Mutex.RUnlock()
+	return n.Transports[Address]
+}
+
+func (n *MemoryNetwork) deliver(Address string, f func(*MemoryTransport)) {
+	deliver := func() {
+		//The destination may have closed while the delivery was scheduled
+		destination := n.transport(Address)
+		if destination != nil {
+			f(destination)
+		}
+	}
+	if n.Clock == nil {
+		deliver()
+		return
+	}
+	n.Clock.AfterFunc(n.Latency, deliver)
+}
+
+func (t *MemoryTransport) Listen(IP string, Port int, Packets PacketHandler, Streams StreamHandler) error {
+	address := net.JoinHostPort(IP, strconv.Itoa(Port))
+	t.network.Mutex.Lock()
+	defer t.network.Mutex.Unlock()
+	if t.network.Transports[address] != nil {
+		return errors.New("Address already in use")
+	}
+	t.Address = address
+	t.packets = Packets
+	t.streams = Streams
+	t.network.Transports[address] = t
+	return nil
+}
+
+func (t *MemoryTransport) WritePacket(Address string, Packet []byte) error {
+	//Like UDP, packets to nobody are silently lost
+	packet := append([]byte(nil), Packet...)
+	t.network.deliver(Address, func(destination *MemoryTransport) {
+		destination.packets(t.Address, packet)
+	})
+	return nil
+}
+
+func (t *MemoryTransport) WriteStream(Address string, Message []byte) error {
+	destination := t.network.transport(Address)
+	if destination == nil {
+		return errors.New("Connection refused")
+	}
+	message := append([]byte(nil), Message...)
+	t.network.deliver(Address, func(destination *MemoryTransport) {
+		destination.streams(t.Address, message)
+	})
+	return nil
+}
+
+func (t *MemoryTransport) Close() error {
+	t.network.Mutex.Lock()
+	if t.network.Transports[t.Address] == t {
+		delete(t.network.Transports, t.Address)
+	}
+	t.network.Mutex.Unlock()
+	return nil
+}
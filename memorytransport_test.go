@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	network := NewMemoryNetwork()
+	packets := make(chan string, 1)
+	T := network.NewTransport()
+	err := T.Listen("127.0.0.1", 1, func(Address string, Packet []byte) {
+		packets <- Address + " " + string(Packet)
+	}, func(Address string, Message []byte) {})
+	if err != nil {
+		t.Error(err)
+	}
+	err = network.NewTransport().Listen("127.0.0.1", 1, nil, nil)
+	if err == nil {
+		t.Error(errors.New("Listening on a used address should fail"))
+	}
+	T2 := network.NewTransport()
+	T2.Listen("127.0.0.1", 2, func(Address string, Packet []byte) {}, func(Address string, Message []byte) {})
+	T2.WritePacket("127.0.0.1:1", []byte("Hello"))
+	if <-packets != "127.0.0.1:2 Hello" {
+		t.Error(errors.New("Packet did not arrive intact"))
+	}
+	err = T2.WriteStream("127.0.0.1:3", []byte("Hello"))
+	if err == nil {
+		t.Error(errors.New("Stream to a missing address should fail"))
+	}
+	T.Close()
+	err = T2.WritePacket("127.0.0.1:1", []byte("Hello"))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryCluster(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(2048)
+	RSA.GenerateKey()
+	network := NewMemoryNetwork()
+	C := Cluster{Transport: network.NewTransport()}
+	C.Start("127.0.0.1", 1, RSA.Key, 1)
+	C2 := Cluster{Transport: network.NewTransport()}
+	err := C2.Bootstrap("127.0.0.1", "127.0.0.1", 2, 1, RSA.Key, 1)
+	if err != nil {
+		t.Error(err)
+	}
+	C3 := Cluster{Transport: network.NewTransport()}
+	err = C3.Bootstrap("127.0.0.1", "127.0.0.1", 3, 2, RSA.Key, 1)
+	if err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Second * 2)
+	C.PeersMutex.RLock()
+	C2.PeersMutex.RLock()
+	C3.PeersMutex.RLock()
+	if !reflect.DeepEqual(C.Peers, C2.Peers) || !reflect.DeepEqual(C3.Peers, C2.Peers) {
+		t.Error(errors.New("Peers did not propagate"))
+	}
+	C.PeersMutex.RUnlock()
+	C2.PeersMutex.RUnlock()
+	C3.PeersMutex.RUnlock()
+	C.Shutdown()
+	C2.Shutdown()
+	C3.Shutdown()
+}
+
+// streamCounter counts the stream messages large enough to be a payload
+type streamCounter struct {
+	Transport
+	Large int32
+}
+
+func (t *streamCounter) WriteStream(Address string, Message []byte) error {
+	if len(Message) > 1<<20 {
+		atomic.AddInt32(&t.Large, 1)
+	}
+	return t.Transport.WriteStream(Address, Message)
+}
+
+func TestSendStreamMessage(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(2048)
+	RSA.GenerateKey()
+	network := NewMemoryNetwork()
+	transport := &streamCounter{Transport: network.NewTransport()}
+	C := Cluster{Transport: transport}
+	C.Start("127.0.0.1", 1, RSA.Key, 1)
+	C2 := Cluster{Transport: network.NewTransport()}
+	C2.Bootstrap("127.0.0.1", "127.0.0.1", 2, 1, RSA.Key, 1)
+	received := make(chan []byte, 2)
+	C2.RegisterHandler("large", func(From string, Payload []byte) {
+		received <- Payload
+	})
+	waitForPeer(&C, C2.LocalPeer.ID)
+	waitForPeer(&C2, C.LocalPeer.ID)
+	payload := make([]byte, 1<<20)
+	rand.Read(payload)
+	for i := 0; i < 2; i++ {
+		err := C.Send(C2.LocalPeer.ID, "large", payload)
+		if err != nil {
+			t.Error(err)
+		}
+		select {
+		case result := <-received:
+			if !bytes.Equal(result, payload) {
+				t.Error(errors.New("Payload did not arrive intact"))
+			}
+		case <-time.After(time.Second * 5):
+			t.Error(errors.New("Message was not delivered"))
+		}
+	}
+	//Payloads over the MTU go over a stream rather than as fragments
+	if atomic.LoadInt32(&transport.Large) != 2 {
+		t.Error(errors.New("Large messages were not sent over a stream"))
+	}
+	C.Shutdown()
+	C2.Shutdown()
+}
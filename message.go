@@ -20,11 +20,24 @@ type EncryptedMessage struct {
 	Message []byte
 	Key     []byte
 	Nonce   []byte
+	//Admission messages use the shared cluster key instead of identity keys
+	Admission bool
+	//Set when the message is sealed under a session instead. Messages with
+	//neither are handshakes, which are only signed with identity keys
+	Session string
+	//Set on a join and its reply encrypted under an invite token instead
+	Invite string
 }
 
 type Header struct {
-	ID   int
-	From string
+	ID            int
+	From          string
+	CorrelationID string
+	Sequence      uint64
+	Order         uint64
+	//Signed with the header so a captured message can not be replayed later
+	Timestamp int64
+	Nonce     uint64
 }
 
 type Body struct {
@@ -32,8 +45,32 @@ type Body struct {
 }
 
 type Gossip struct {
-	Peers  []Peer
-	Values map[string]*Value
+	Peers []Peer
+	//Digest of the sender's peer IDs, sent without Peers when pushing
+	PeerDigest uint64
+	Values     map[string]*Value
+	Events     []UserEvent
+	//Topics each peer subscribes to, keyed by peer ID
+	Subscriptions map[string]TopicSubscription
+	Keyring       KeyringState
+	//Certificate revocation list signed by the cluster CA
+	Revocations []byte
+	Bans        []Ban
+}
+
+type DirectMessage struct {
+	Type    string
+	Payload []byte
+}
+
+type RPCRequest struct {
+	Method  string
+	Payload []byte
+}
+
+type RPCResponse struct {
+	Payload []byte
+	Error   string
 }
 
 type ChunkRequest struct {
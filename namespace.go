@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"strings"
+)
+
+// SealedValue holds the contents of a value in an encrypted namespace. The
+// contents are encrypted with a fresh data key, which is itself encrypted
+// with the namespace key, so peers without the namespace key can still
+// store, verify and gossip the value
+type SealedValue struct {
+	Namespace  string
+	WrappedKey []byte
+	KeyNonce   []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// AddNamespaceKey encrypts values under the prefix from now on and lets the
+// local peer read them. Every peer that should read them needs the same key
+func (c *Cluster) AddNamespaceKey(Prefix string, Key []byte) error {
+	if len(Key) != 32 {
+		return errors.New("Namespace key must be 32 bytes")
+	}
+	c.NamespaceMutex.Lock()
+	c.NamespaceKeys[Prefix] = Key
+	c.NamespaceMutex.Unlock()
+	return nil
+}
+
+// namespaceFor returns the longest prefix with a key that covers Key
+func (c *Cluster) namespaceFor(Key string) (string, []byte) {
+	c.NamespaceMutex.RLock()
+	defer c.NamespaceMutex.RUnlock()
+	namespace := ""
+	var namespaceKey []byte
+	for prefix, key := range c.NamespaceKeys {
+		if strings.HasPrefix(Key, prefix) && (namespaceKey == nil || len(prefix) > len(namespace)) {
+			namespace, namespaceKey = prefix, key
+		}
+	}
+	return namespace, namespaceKey
+}
+
+// SealValue encrypts a value's contents when its key is in an encrypted
+// namespace, before it is signed
+func (c *Cluster) SealValue(Key string, v *Value) error {
+	namespace, namespaceKey := c.namespaceFor(Key)
+	if namespaceKey == nil {
+		return nil
+	}
+	contents := bytes.Buffer{}
+	err := gob.NewEncoder(&contents).Encode(v.Value)
+	if err != nil {
+		return err
+	}
+	dataKey, err := GenerateAESKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	sealed := &SealedValue{Namespace: namespace}
+	sealed.Nonce, err = GenerateAESNonce(rand.Reader)
+	if err != nil {
+		return err
+	}
+	sealed.Ciphertext, err = Encrypt(contents.Bytes(), dataKey, sealed.Nonce)
+	if err != nil {
+		return err
+	}
+	sealed.KeyNonce, err = GenerateAESNonce(rand.Reader)
+	if err != nil {
+		return err
+	}
+	sealed.WrappedKey, err = Encrypt(dataKey, namespaceKey, sealed.KeyNonce)
+	if err != nil {
+		return err
+	}
+	v.Sealed = sealed
+	v.Value = nil
+	return nil
+}
+
+// GetValue returns the contents of a value, decrypting them if the value is
+// in an encrypted namespace
+func (c *Cluster) GetValue(Key string) (map[string]interface{}, error) {
+	c.ValuesMutex.RLock()
+	value := c.Values[Key]
+	c.ValuesMutex.RUnlock()
+	if value == nil {
+		return nil, errors.New("No value for " + Key)
+	}
+	if value.Sealed == nil {
+		return value.Value, nil
+	}
+	c.NamespaceMutex.RLock()
+	namespaceKey := c.NamespaceKeys[value.Sealed.Namespace]
+	c.NamespaceMutex.RUnlock()
+	if namespaceKey == nil {
+		return nil, errors.New("No key for namespace " + value.Sealed.Namespace)
+	}
+	dataKey, err := Decrypt(value.Sealed.WrappedKey, namespaceKey, value.Sealed.KeyNonce)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := Decrypt(value.Sealed.Ciphertext, dataKey, value.Sealed.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	contents := make(map[string]interface{})
+	err = gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&contents)
+	if err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEncryptedNamespace(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	key, _ := GenerateAESKey(rand.Reader)
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 3; i++ {
+		S.AddNode()
+	}
+	S.Run(time.Second * 2)
+	writer, reader, outsider := S.Clusters[0], S.Clusters[1], S.Clusters[2]
+	writer.AddNamespaceKey("secrets/", key)
+	reader.AddNamespaceKey("secrets/", key)
+	if outsider.AddNamespaceKey("secrets/", key[:16]) == nil {
+		t.Error(errors.New("Short namespace key should be refused"))
+	}
+
+	err := writer.SetValue("secrets/db", map[string]interface{}{"password": "hunter2"}, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	writer.SetValue("config/db", map[string]interface{}{"host": "db1"}, 0)
+	S.Run(time.Second * 5)
+
+	//Every peer replicates the ciphertext
+	for _, C := range S.Clusters {
+		value := C.Values["secrets/db"]
+		if value == nil || value.Sealed == nil || value.Value != nil {
+			t.Fatal(errors.New("Encrypted value did not spread sealed"))
+		}
+		if bytes.Contains(value.Sealed.Ciphertext, []byte("hunter2")) {
+			t.Error(errors.New("Value was not encrypted"))
+		}
+	}
+	contents, err := reader.GetValue("secrets/db")
+	if err != nil || contents["password"] != "hunter2" {
+		t.Error(errors.New("Key holder should read the value"))
+	}
+	if _, err := outsider.GetValue("secrets/db"); err == nil {
+		t.Error(errors.New("Peer without the key should not read the value"))
+	}
+	contents, err = outsider.GetValue("config/db")
+	if err != nil || contents["host"] != "db1" {
+		t.Error(errors.New("Values outside the namespace should read as usual"))
+	}
+	S.Shutdown()
+}
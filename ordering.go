@@ -0,0 +1,206 @@
+package main
+
+import (
+	"sync"
+)
+
+// OrderedSender buffers one sender's ordered messages that arrived early
+type OrderedSender struct {
+	Next    uint64
+	Pending map[uint64]Message
+	//Set while a timer is waiting to skip a gap that never filled
+	Waiting bool
+	Mutex   *sync.Mutex
+}
+
+// NextOrder assigns the next FIFO position for messages sent to a peer
+func (c *Cluster) NextOrder(PeerID string) uint64 {
+	c.OrderMutex.Lock()
+	defer c.OrderMutex.Unlock()
+	c.OrderSequences[PeerID]++
+	return c.OrderSequences[PeerID]
+}
+
+func (c *Cluster) orderedSender(PeerID string) *OrderedSender {
+	c.OrderMutex.Lock()
+	defer c.OrderMutex.Unlock()
+	sender := c.OrderedSenders[PeerID]
+	if sender == nil {
+		sender = &OrderedSender{Next: 1, Pending: make(map[uint64]Message), Mutex: new(sync.Mutex)}
+		c.OrderedSenders[PeerID] = sender
+	}
+	return sender
+}
+
+// DropOrdering forgets the ordered messages buffered from a peer that left
+// or rejoined, so a rejoined peer's messages are delivered from its first
+func (c *Cluster) DropOrdering(PeerID string) {
+	c.OrderMutex.Lock()
+	delete(c.OrderedSenders, PeerID)
+	c.OrderMutex.Unlock()
+}
+
+func (p *Peer) DeliverInOrder(m Message) error {
+	sender := p.parentCluster.orderedSender(m.Header.From)
+	//Delivery happens under the sender's lock so handlers see messages in order
+	sender.Mutex.Lock()
+	defer sender.Mutex.Unlock()
+	if m.Header.Order < sender.Next {
+		//Already delivered or skipped
+		return nil
+	}
+	sender.Pending[m.Header.Order] = m
+	if len(sender.Pending) > p.parentCluster.MaxPendingOrdered {
+		p.skipGap(sender)
+	}
+	p.drainOrdered(sender)
+	if len(sender.Pending) > 0 && !sender.Waiting {
+		sender.Waiting = true
+		p.parentCluster.Clock.AfterFunc(p.parentCluster.OrderTimeout, func() {
+			p.expireGap(sender)
+		})
+	}
+	return nil
+}
+
+func (p *Peer) drainOrdered(sender *OrderedSender) {
+	for {
+		m, ok := sender.Pending[sender.Next]
+		if !ok {
+			return
+		}
+		delete(sender.Pending, sender.Next)
+		sender.Next++
+		p.deliverDirectMessage(m)
+	}
+}
+
+// skipGap gives up on missing messages and moves on to the oldest buffered one
+func (p *Peer) skipGap(sender *OrderedSender) {
+	lowest := uint64(0)
+	for order := range sender.Pending {
+		if lowest == 0 || order < lowest {
+			lowest = order
+		}
+	}
+	if lowest > sender.Next {
+		sender.Next = lowest
+	}
+}
+
+func (p *Peer) expireGap(sender *OrderedSender) {
+	sender.Mutex.Lock()
+	defer sender.Mutex.Unlock()
+	sender.Waiting = false
+	if len(sender.Pending) == 0 {
+		return
+	}
+	//Messages lost without retransmission would otherwise block the sender forever
+	p.skipGap(sender)
+	p.drainOrdered(sender)
+	if len(sender.Pending) > 0 {
+		sender.Waiting = true
+		p.parentCluster.Clock.AfterFunc(p.parentCluster.OrderTimeout, func() {
+			p.expireGap(sender)
+		})
+	}
+}
+
+// NextCausalVector returns the vector timestamp for a new causal event
+func (c *Cluster) NextCausalVector() map[string]uint64 {
+	c.CausalMutex.Lock()
+	defer c.CausalMutex.Unlock()
+	vector := make(map[string]uint64)
+	for id, delivered := range c.CausalClock {
+		vector[id] = delivered
+	}
+	c.CausalSent++
+	vector[c.LocalPeer.ID] = c.CausalSent
+	return vector
+}
+
+// DeliverCausal buffers a causal event until every event it depends on has
+// been delivered, then delivers it and anything that was waiting on it
+func (c *Cluster) DeliverCausal(Event UserEvent) {
+	c.CausalMutex.Lock()
+	c.CausalPending = append(c.CausalPending, Event)
+	if len(c.CausalPending) > c.MaxEvents {
+		//Dependencies of the oldest event were lost. Skip past them so it and
+		//the events after it are delivered rather than waiting forever
+		index := oldestPending(c.CausalPending)
+		oldest := c.CausalPending[index]
+		for id, count := range oldest.Vector {
+			if id == oldest.Origin {
+				count--
+			}
+			if count > c.CausalClock[id] {
+				c.CausalClock[id] = count
+			}
+		}
+		if !c.causallyReady(oldest) {
+			//Already delivered
+			c.CausalPending = append(c.CausalPending[:index], c.CausalPending[index+1:]...)
+		}
+	}
+	for ready := true; ready; {
+		ready = false
+		for i := 0; i < len(c.CausalPending); i++ {
+			event := c.CausalPending[i]
+			if !c.causallyReady(event) {
+				continue
+			}
+			c.CausalPending = append(c.CausalPending[:i], c.CausalPending[i+1:]...)
+			c.CausalClock[event.Origin] = event.Vector[event.Origin]
+			c.CausalReady = append(c.CausalReady, event)
+			ready = true
+			break
+		}
+	}
+	//One caller at a time delivers the queue so handlers see causal order,
+	//and a handler broadcasting in turn only queues its own event
+	if c.CausalDelivering {
+		c.CausalMutex.Unlock()
+		return
+	}
+	c.CausalDelivering = true
+	for len(c.CausalReady) > 0 {
+		event := c.CausalReady[0]
+		c.CausalReady = c.CausalReady[1:]
+		c.CausalMutex.Unlock()
+		c.deliverEvent(event)
+		c.CausalMutex.Lock()
+	}
+	c.CausalDelivering = false
+	c.CausalMutex.Unlock()
+}
+
+// oldestPending finds the event with the smallest vector. An event's vector
+// sums to more than those of the events it depends on, so the smallest comes
+// first causally whatever order the events arrived in
+func oldestPending(Events []UserEvent) int {
+	oldest := 0
+	smallest := uint64(0)
+	for i, event := range Events {
+		sum := uint64(0)
+		for _, count := range event.Vector {
+			sum += count
+		}
+		if i == 0 || sum < smallest || (sum == smallest && event.ID < Events[oldest].ID) {
+			oldest = i
+			smallest = sum
+		}
+	}
+	return oldest
+}
+
+func (c *Cluster) causallyReady(Event UserEvent) bool {
+	if Event.Vector[Event.Origin] != c.CausalClock[Event.Origin]+1 {
+		return false
+	}
+	for id, count := range Event.Vector {
+		if id != Event.Origin && count > c.CausalClock[id] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrderedDelivery(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	C, _ := S.AddNode()
+	C2, _ := S.AddNode()
+	received := make([]int, 0)
+	C2.RegisterHandler("count", func(From string, Payload []byte) {
+		count, _ := strconv.Atoi(string(Payload))
+		received = append(received, count)
+	})
+	S.Run(time.Second * 2)
+
+	S.Faults.SetConfig(FaultConfig{Reorder: 0.5, Latency: time.Millisecond * 10, Jitter: time.Millisecond * 50})
+	for i := 0; i < 20; i++ {
+		C.Send(C2.LocalPeer.ID, "count", []byte(strconv.Itoa(i)))
+	}
+	S.Run(time.Second)
+	if len(received) != 20 {
+		t.Error(errors.New("Messages were not all delivered"))
+	}
+	for i := range received {
+		if received[i] != i {
+			t.Error(errors.New("Messages were not delivered in order"))
+			break
+		}
+	}
+
+	//Lost messages are skipped once the order timeout passes
+	S.Faults.SetConfig(FaultConfig{Loss: 0.3, Reorder: 0.5, Latency: time.Millisecond * 10, Jitter: time.Millisecond * 50})
+	received = received[:0]
+	for i := 0; i < 20; i++ {
+		C.Send(C2.LocalPeer.ID, "count", []byte(strconv.Itoa(i)))
+	}
+	S.Run(time.Second * 5)
+	if len(received) == 0 || len(received) == 20 {
+		t.Error(errors.New("Expected some but not all messages to arrive"))
+	}
+	for i := 1; i < len(received); i++ {
+		if received[i] <= received[i-1] {
+			t.Error(errors.New("Messages after a gap were not delivered in order"))
+			break
+		}
+	}
+	S.Shutdown()
+}
+
+func TestRejoinResetsOrdering(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	C, _ := S.AddNode()
+	C2, _ := S.AddNode()
+	received := make([]string, 0)
+	C.RegisterHandler("count", func(From string, Payload []byte) {
+		received = append(received, string(Payload))
+	})
+	S.Run(time.Second * 2)
+	for i := 0; i < 3; i++ {
+		C2.Send(C.LocalPeer.ID, "count", []byte(strconv.Itoa(i)))
+	}
+	S.Run(time.Second)
+
+	//The restarted node orders its messages from the start again
+	rejoined := rejoinNode(t, S, C2)
+	S.Run(time.Second * 2)
+	received = received[:0]
+	rejoined.Send(C.LocalPeer.ID, "count", []byte("again"))
+	S.Run(time.Second)
+	if !reflect.DeepEqual(received, []string{"again"}) {
+		t.Error(errors.New("Rejoined peer's first message was not delivered"))
+	}
+
+	//Nothing is kept for a peer once it ages out
+	rejoined.Shutdown()
+	S.Run(C.PeerTimeout * 2)
+	C.OrderMutex.Lock()
+	ordered := C.OrderedSenders[C2.LocalPeer.ID]
+	C.OrderMutex.Unlock()
+	if ordered != nil {
+		t.Error(errors.New("Departed peer's ordering should be pruned"))
+	}
+	S.Shutdown()
+}
+
+func TestCausalDelivery(t *testing.T) {
+	C := Cluster{CausalClock: make(map[string]uint64), CausalMutex: new(sync.Mutex), EventsMutex: new(sync.Mutex), EventHandlers: make(map[string][]EventHandler), MaxEvents: 10}
+	delivered := make([]string, 0)
+	C.SubscribeEvent("", func(Event UserEvent) {
+		delivered = append(delivered, Event.ID)
+	})
+	//b2 depends on a1 and b1, b1 depends on a1
+	C.DeliverCausal(UserEvent{ID: "b2", Name: "edit", Origin: "b", Vector: map[string]uint64{"a": 1, "b": 2}})
+	C.DeliverCausal(UserEvent{ID: "b1", Name: "edit", Origin: "b", Vector: map[string]uint64{"a": 1, "b": 1}})
+	if len(delivered) != 0 {
+		t.Error(errors.New("Event was delivered before its dependencies"))
+	}
+	C.DeliverCausal(UserEvent{ID: "a1", Name: "edit", Origin: "a", Vector: map[string]uint64{"a": 1}})
+	if !reflect.DeepEqual(delivered, []string{"a1", "b1", "b2"}) {
+		t.Error(errors.New("Events were not delivered in causal order"))
+	}
+}
+
+func TestCausalOverflow(t *testing.T) {
+	C := Cluster{CausalClock: make(map[string]uint64), CausalMutex: new(sync.Mutex), EventsMutex: new(sync.Mutex), EventHandlers: make(map[string][]EventHandler), MaxEvents: 3}
+	delivered := make([]string, 0)
+	C.SubscribeEvent("", func(Event UserEvent) {
+		delivered = append(delivered, Event.ID)
+	})
+	//a1 is lost, so a2 onwards wait until the buffer overflows
+	for i := uint64(2); i <= 5; i++ {
+		C.DeliverCausal(UserEvent{ID: "a" + strconv.FormatUint(i, 10), Name: "edit", Origin: "a", Vector: map[string]uint64{"a": i}})
+	}
+	if !reflect.DeepEqual(delivered, []string{"a2", "a3", "a4", "a5"}) {
+		t.Error(errors.New("Events after the gap were not delivered"))
+	}
+	C.DeliverCausal(UserEvent{ID: "a6", Name: "edit", Origin: "a", Vector: map[string]uint64{"a": 6}})
+	if len(delivered) != 5 || C.CausalClock["a"] != 6 {
+		t.Error(errors.New("Origin stalled after the gap"))
+	}
+
+	//The buffer fills out of order, and the gap is skipped to the earliest
+	C = Cluster{CausalClock: make(map[string]uint64), CausalMutex: new(sync.Mutex), EventsMutex: new(sync.Mutex), EventHandlers: make(map[string][]EventHandler), MaxEvents: 3}
+	delivered = delivered[:0]
+	C.SubscribeEvent("", func(Event UserEvent) {
+		delivered = append(delivered, Event.ID)
+	})
+	for _, i := range []uint64{5, 3, 2, 4} {
+		C.DeliverCausal(UserEvent{ID: "a" + strconv.FormatUint(i, 10), Name: "edit", Origin: "a", Vector: map[string]uint64{"a": i}})
+	}
+	if !reflect.DeepEqual(delivered, []string{"a2", "a3", "a4", "a5"}) {
+		t.Error(errors.New("Events buffered out of order were not delivered in order"))
+	}
+}
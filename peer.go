@@ -2,88 +2,87 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
+	"crypto"
 	"crypto/rsa"
 	"encoding/gob"
-	"fmt"
-	"math/big"
+	"errors"
 	"net"
 	"strconv"
-	"time"
+	"sync/atomic"
 )
 
 type Peer struct {
 	ID            string
 	IP            string
 	Port          int
+	Tags          map[string]string
+	Suite         string
+	PublicKey     []byte
+	Certificate   []byte
+	Roles         []string
+	Admitter      string
+	Admission     []byte
 	RSA           *RSAUtil
-	server        *net.UDPConn
+	identity      crypto.Signer
+	transport     Transport
 	parentCluster *Cluster
-	Stopped       bool
+	//Set once the peer stops listening, read by timers on other goroutines
+	stopped int32
 }
 
 func (p *Peer) StopListening() error {
-	//Close UDPConn
-	err := p.server.Close()
-	if err != nil {
-		return err
-	}
-	p.Stopped = true
-	return nil
+	atomic.StoreInt32(&p.stopped, 1)
+	//Close transport
+	return p.transport.Close()
+}
+
+// Stopped reports whether the peer has stopped listening
+func (p *Peer) Stopped() bool {
+	return atomic.LoadInt32(&p.stopped) == 1
 }
 
 func (p *Peer) StartListening() error {
-	//Create UDPConn
-	u, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(p.IP), Port: p.Port})
-	if err != nil {
-		return err
+	//Use UDP and TCP unless another transport was provided
+	if p.transport == nil {
+		p.transport = NewNetTransport()
 	}
-	//Assign UDPConn to Peer
-	p.server = u
-
-	//Listen to incoming messages
-	go func() {
+	//Listen to incoming packets and stream messages
+	return p.transport.Listen(p.IP, p.Port, func(Address string, packet []byte) {
+		p.parentCluster.Enqueue(Address, func() {
+			p.HandlePacket(Address, packet)
+		})
+	}, func(Address string, message []byte) {
+		p.parentCluster.Enqueue(Address, func() {
+			p.ReceiveMessage(Address, message)
+		})
+	})
+}
 
-		for {
-			if p.Stopped == true {
-				break
-			}
-			buf := make([]byte, 65507)
-			//Read data from connection
-			n, _, err := p.server.ReadFrom(buf)
-			if err != nil {
-				continue
-			}
-			//Pass message to handle message
-			go p.HandleMessage(buf[:n])
-		}
-	}()
-
-	// t, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(p.IP), Port: p.Port + 1})
-	// if err != nil {
-	// 	return err
-	// }
-	// p.fileServer = t
-
-	// go func() {
-	// 	defer p.fileServer.Close()
-	// 	for {
-	// 		if p.Stopped == true {
-	// 			break
-	// 		}
-
-	// 		conn, err := p.fileServer.Accept()
-	// 		if err != nil {
-	// 			continue
-	// 		}
-	// 		go p.HandleFileMessage(conn)
-	// 	}
-	// }()
+func (p *Peer) Address() string {
+	return net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+}
 
-	return nil
+func (p *Peer) HandlePacket(Address string, packet []byte) error {
+	//Reassemble fragmented messages before decoding
+	message, err := p.parentCluster.ReassemblePacket(Address, packet)
+	if err != nil {
+		p.parentCluster.penalizeInvalid(Address)
+		return err
+	}
+	if message == nil {
+		return nil
+	}
+	return p.ReceiveMessage(Address, message)
 }
 
 func (p *Peer) HandleMessage(message []byte) error {
+	return p.ReceiveMessage("", message)
+}
+
+// ReceiveMessage handles a message from an address, holding anything that
+// does not decode or verify against the address and protocol violations in
+// verified messages against the sending peer as well
+func (p *Peer) ReceiveMessage(Address string, message []byte) error {
 	//Fill bytes.Buffer with message
 	messageBytes := bytes.Buffer{}
 	_, err := messageBytes.Write(message)
@@ -97,37 +96,140 @@ func (p *Peer) HandleMessage(message []byte) error {
 	//Decode message
 	err = decoder.Decode(&m)
 	if err != nil {
+		p.parentCluster.penalizeInvalid(Address)
 		return err
 	}
 
-	//Decrypt message
-	decryptedMessage, err := m.Decrypt(*p.RSA)
+	decryptedMessage, err := p.OpenMessage(m)
 	if err != nil {
+		p.parentCluster.penalizeInvalid(Address)
 		return err
 	}
-
-	//Verify message
-	err = decryptedMessage.VerifyMessage(*p.RSA)
-	if err != nil {
-		return err
+	if p.parentCluster.IsBanned(decryptedMessage.Header.From) {
+		p.parentCluster.CountDrop(DropBanned)
+		return errors.New("Rejected message from a banned peer")
+	}
+	//Reject messages seen before or signed outside the replay window
+	reason := p.parentCluster.CheckReplay(decryptedMessage.Header)
+	if reason != "" {
+		//Anyone who captured a message can replay it, so a replay says
+		//nothing about the peer that signed it
+		p.parentCluster.CountSecurityEvent(reason)
+		//A retransmission whose ack was lost still needs acknowledging
+		if reason == SecurityReplayed && decryptedMessage.Header.Sequence != 0 && decryptedMessage.Header.ID != 7 {
+			p.SendAck(*decryptedMessage)
+		}
+		return errors.New("Rejected " + reason + " message")
 	}
 	p.parentCluster.LastSeenPeerMutex.Lock()
-	p.parentCluster.LastSeenPeer[decryptedMessage.Header.From] = time.Now().UTC().Unix()
+	p.parentCluster.LastSeenPeer[decryptedMessage.Header.From] = p.parentCluster.Clock.Now().UTC().Unix()
 	p.parentCluster.LastSeenPeerMutex.Unlock()
 
+	//Acknowledge reliable messages and drop retransmissions already handled
+	if decryptedMessage.Header.Sequence != 0 && decryptedMessage.Header.ID != 7 {
+		//A lost ack is recovered by the sender retransmitting
+		p.SendAck(*decryptedMessage)
+		if !p.parentCluster.ObserveSequence(decryptedMessage.Header.From, decryptedMessage.Header.Sequence) {
+			return nil
+		}
+	}
+
 	switch decryptedMessage.Header.ID {
 	case 0:
-		p.HandleBootstrap(*decryptedMessage)
+		if m.Invite != "" {
+			p.HandleInviteBootstrap(*decryptedMessage, m.Invite)
+		} else {
+			p.HandleBootstrap(*decryptedMessage)
+		}
 	case 1:
-		p.HandleNewPeers(*decryptedMessage)
+		//Only the reply to this peer's own join comes under the cluster key or
+		//an invite
+		if m.Admission || m.Invite != "" {
+			p.HandleJoinReply(*decryptedMessage)
+		} else {
+			p.HandleNewPeers(*decryptedMessage)
+		}
 	case 2:
 		p.HandleNewPeers(*decryptedMessage)
 	case 3:
 		p.HandleNewPeers(*decryptedMessage)
+	case 4:
+		return p.HandleDirectMessage(*decryptedMessage)
+	case 5:
+		return p.HandleRPCRequest(*decryptedMessage)
+	case 6:
+		return p.HandleRPCResponse(*decryptedMessage)
+	case 7:
+		return p.HandleAck(*decryptedMessage)
+	case 8:
+		return p.HandleEvent(*decryptedMessage)
+	case 9:
+		return p.HandleQuery(*decryptedMessage)
+	case 10:
+		return p.HandleQueryReply(*decryptedMessage)
+	case 11:
+		return p.HandleTopicMessage(*decryptedMessage)
+	case 12:
+		return p.HandleHandshake(*decryptedMessage)
+	case 13:
+		return p.HandleHandshakeResponse(*decryptedMessage)
 	}
 	return nil
 }
 
+// malformed penalizes the sender of a verified message whose body does not
+// match its type
+func (p *Peer) malformed(m Message) error {
+	p.parentCluster.Penalize("", m.Header.From, PenaltyProtocol, "malformed")
+	return errors.New("Malformed message body")
+}
+
+// OpenMessage decrypts a message and checks it was signed by its sender
+func (p *Peer) OpenMessage(m EncryptedMessage) (*Message, error) {
+	if m.Admission {
+		//Only joining the cluster is allowed with the shared cluster key
+		decryptedMessage, err := p.parentCluster.DecryptAdmission(m)
+		if err != nil {
+			return nil, err
+		}
+		if decryptedMessage.Header.ID != 0 && decryptedMessage.Header.ID != 1 {
+			return nil, errors.New("Message type not allowed with the cluster key")
+		}
+		//Anyone holding the cluster key could otherwise push state to members
+		if decryptedMessage.Header.ID == 1 {
+			err = p.parentCluster.AcceptJoinReply(decryptedMessage)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return decryptedMessage, nil
+	}
+	if m.Session != "" {
+		return p.OpenSessionMessage(m)
+	}
+	if m.Invite != "" {
+		return p.parentCluster.OpenInviteMessage(m)
+	}
+	//Handshakes carry only public ephemeral keys so they are signed but not encrypted
+	decryptedMessage := &Message{}
+	err := gob.NewDecoder(bytes.NewReader(m.Message)).Decode(decryptedMessage)
+	if err != nil {
+		return nil, err
+	}
+	//Identity keys only set up sessions
+	if decryptedMessage.Header.ID != 12 && decryptedMessage.Header.ID != 13 {
+		return nil, errors.New("Message type not allowed with identity keys")
+	}
+	//The signature must come from the key registered for the claimed sender
+	p.parentCluster.PeersMutex.RLock()
+	sender := p.parentCluster.Peers[decryptedMessage.Header.From]
+	p.parentCluster.PeersMutex.RUnlock()
+	if sender == nil || sender.PublicKey == nil {
+		return nil, errors.New("Unknown peer")
+	}
+	return decryptedMessage, decryptedMessage.VerifyWith(p.parentCluster.Suite, sender.PublicKey)
+}
+
 func (p *Peer) InitializeRSAUtil(length int, Key *rsa.PrivateKey) error {
 	//Create RSAUtil struct
 	p.RSA = &RSAUtil{}
@@ -155,165 +257,402 @@ func (p *Peer) InitializeRSAUtil(length int, Key *rsa.PrivateKey) error {
 	return nil
 }
 
+// InitializeIdentity sets the key pair that identifies this peer to others,
+// generating one from the suite if none is passed in
+func (p *Peer) InitializeIdentity(Suite Suite, Key crypto.Signer) error {
+	if Key == nil {
+		var err error
+		Key, err = Suite.GenerateKey()
+		if err != nil {
+			return err
+		}
+	}
+	publicKey, err := MarshalPublicKey(Key)
+	if err != nil {
+		return err
+	}
+	p.identity = Key
+	p.Suite = Suite.Name()
+	p.PublicKey = publicKey
+	return nil
+}
+
 func (p *Peer) SendMessage(p2 Peer, m Message) error {
+	session := p.Session(p2)
+	if session == nil {
+		return p.parentCluster.QueueMessage(p2, m, false)
+	}
+	messageBytes, err := p.SealMessage(session, m)
+	if err != nil {
+		return err
+	}
+	//Messages too large for datagrams go over a stream
+	if len(messageBytes) > p.parentCluster.StreamThreshold {
+		return p.WriteStream(p2, messageBytes)
+	}
+	return p.WritePacket(p2, messageBytes)
+}
 
+func (p *Peer) EncodeMessage(p2 Peer, m Message) ([]byte, error) {
+	if p2.PublicKey == nil {
+		return nil, errors.New("Unknown public key for peer")
+	}
+	p.parentCluster.StampHeader(&m.Header)
 	//Sign Message
-	err := m.SignMessage(*p.RSA)
+	err := m.SignWith(p.parentCluster.Suite, p.identity)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	//Encrypt Message
-	encryptedMessage, err := m.Encrypt(*p.RSA)
+	messageBytes, err := m.Encode()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	encryptedMessage := EncryptedMessage{Message: messageBytes}
+	return encryptedMessage.Encode()
+}
 
-	//Encode Message
-	messageBytes, err := encryptedMessage.Encode()
+// EncodeAdmissionMessage signs and encrypts with the primary cluster key, for
+// joining peers whose identity keys are not yet known
+func (p *Peer) EncodeAdmissionMessage(m Message) ([]byte, error) {
+	p.parentCluster.StampHeader(&m.Header)
+	RSA, err := p.parentCluster.PrimaryKey()
+	if err != nil {
+		return nil, err
+	}
+	err = m.SignMessage(RSA)
+	if err != nil {
+		return nil, err
+	}
+	encryptedMessage, err := m.Encrypt(RSA)
+	if err != nil {
+		return nil, err
+	}
+	encryptedMessage.Admission = true
+	return encryptedMessage.Encode()
+}
+
+func (p *Peer) WritePacket(p2 Peer, messageBytes []byte) error {
+	//Split the message into datagrams that fit the MTU
+	packets, err := p.parentCluster.FragmentMessage(messageBytes)
 	if err != nil {
 		return err
 	}
+	//Write packets to transport
+	for _, packet := range packets {
+		err = p.transport.WritePacket(p2.Address(), packet)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	go func() {
-		//Prepare UDP Connection
-		conn, _ := net.Dial("udp", p2.IP+":"+strconv.Itoa(p2.Port))
+func (p *Peer) SendStreamMessage(p2 Peer, m Message) error {
+	session := p.Session(p2)
+	if session == nil {
+		return p.parentCluster.QueueMessage(p2, m, true)
+	}
+	messageBytes, err := p.SealMessage(session, m)
+	if err != nil {
+		return err
+	}
+	return p.WriteStream(p2, messageBytes)
+}
 
-		defer conn.Close()
-		//Write message to conn
-		_, err = conn.Write(messageBytes)
+func (p *Peer) WriteStream(p2 Peer, messageBytes []byte) error {
+	return p.transport.WriteStream(p2.Address(), messageBytes)
+}
 
-	}()
+func (p *Peer) HandleBootstrap(m Message) error {
+	//The joiner learns identity keys from the reply, so it uses the cluster key
+	return p.admitJoiner(m, p.EncodeAdmissionMessage)
+}
 
-	return nil
+// HandleInviteBootstrap admits a joiner that redeemed an invite, replying
+// under the invite since the joiner does not have the cluster key yet
+func (p *Peer) HandleInviteBootstrap(m Message, ID string) error {
+	p.parentCluster.InvitesMutex.Lock()
+	invite := p.parentCluster.Invites[ID]
+	if invite == nil || invite.Used {
+		p.parentCluster.InvitesMutex.Unlock()
+		return errors.New("Unknown or used invite")
+	}
+	//Claimed while the joiner is admitted so the invite admits one node
+	invite.Used = true
+	p.parentCluster.InvitesMutex.Unlock()
+	err := p.admitJoiner(m, func(M Message) ([]byte, error) {
+		return p.EncodeInviteMessage(ID, invite.Secret, "reply", M)
+	})
+	if err != nil {
+		//A failed admission leaves the invite for another attempt
+		p.parentCluster.InvitesMutex.Lock()
+		invite.Used = false
+		p.parentCluster.InvitesMutex.Unlock()
+	}
+	return err
 }
 
-func (p *Peer) HandleBootstrap(m Message) error {
-	newPeer := m.Body.Content.(Peer)
+func (p *Peer) admitJoiner(m Message, encode func(Message) ([]byte, error)) error {
+	//The sender is not verified yet, so there is no peer to hold this against
+	newPeer, ok := m.Body.Content.(Peer)
+	if !ok || newPeer.ID != m.Header.From || newPeer.PublicKey == nil {
+		return errors.New("Invalid bootstrap peer")
+	}
+	//Every peer must be able to verify every other peer's handshakes
+	if newPeer.Suite != p.parentCluster.Suite.Name() {
+		return errors.New("Peer uses the " + newPeer.Suite + " suite instead of " + p.parentCluster.Suite.Name())
+	}
+	err := p.parentCluster.AdmitPeer(&newPeer)
+	if err != nil {
+		return err
+	}
 	p.parentCluster.PeersMutex.Lock()
-	p.parentCluster.Peers[newPeer.ID] = &newPeer
+	existing := p.parentCluster.Peers[newPeer.ID]
+	//A known ID keeps its key so the cluster key can not be used to take it
+	//over, even once the peer has left
+	if (existing != nil && !bytes.Equal(existing.PublicKey, newPeer.PublicKey)) || p.parentCluster.keyRetained(newPeer.ID, newPeer.PublicKey) {
+		p.parentCluster.PeersMutex.Unlock()
+		return errors.New("Peer ID already registered with a different key")
+	}
+	err = p.parentCluster.SignAdmission(&newPeer)
+	if err != nil {
+		p.parentCluster.PeersMutex.Unlock()
+		return err
+	}
+	if existing == nil {
+		p.parentCluster.addPeer(&newPeer)
+	} else {
+		p.parentCluster.Peers[newPeer.ID] = &newPeer
+	}
 	p.parentCluster.PeersMutex.Unlock()
-	p.parentCluster.PeerIDs = append(p.parentCluster.PeerIDs, newPeer.ID)
-	peers := make([]Peer, 0)
-	p.parentCluster.PeersMutex.RLock()
-	for _, peer := range p.parentCluster.Peers {
-		peers = append(peers, Peer{ID: peer.ID, IP: peer.IP, Port: peer.Port})
+	//A departed peer that rejoins is welcome again, with fresh sessions
+	p.parentCluster.LastSeenPeerMutex.Lock()
+	delete(p.parentCluster.DepartedPeers, newPeer.ID)
+	p.parentCluster.LastSeenPeerMutex.Unlock()
+	p.parentCluster.DropSessions(newPeer.ID)
+	p.parentCluster.DropSequences(newPeer.ID)
+	p.parentCluster.DropOrdering(newPeer.ID)
+	p.parentCluster.DropSubscriptions(newPeer.ID)
+	M := Message{Header: Header{ID: 1, From: p.ID, CorrelationID: m.Header.CorrelationID}, Body: Body{Content: p.parentCluster.GossipState(newPeer.ID)}}
+	messageBytes, err := encode(M)
+	if err != nil {
+		return err
 	}
-	p.parentCluster.PeersMutex.RUnlock()
-	p.parentCluster.ValuesMutex.RLock()
-	M := Message{Header: Header{ID: 1, From: p.ID}, Body: Body{Content: Gossip{Peers: peers, Values: p.parentCluster.Values}}}
-	p.parentCluster.ValuesMutex.RUnlock()
-	p.SendMessage(newPeer, M)
-	return nil
+	//Full state sync is sent over a stream regardless of size
+	return p.WriteStream(newPeer, messageBytes)
 }
 
 func (p *Peer) HandleNewPeers(m Message) error {
-	gossip := m.Body.Content.(Gossip)
+	return p.mergeGossip(m, false)
+}
+
+// HandleJoinReply merges the state the seed sent back to this peer's join.
+// The seed admitted this peer, so the peers it knows are taken on its word
+func (p *Peer) HandleJoinReply(m Message) error {
+	return p.mergeGossip(m, true)
+}
+
+// mergeGossip merges gossiped state. Without a CA a peer is only added if the
+// binding of its ID to its key comes from the peer itself or the member that
+// admitted it, unless the sender vouches for every peer it sends
+func (p *Peer) mergeGossip(m Message, Vouched bool) error {
+	gossip, ok := m.Body.Content.(Gossip)
+	if !ok {
+		return p.malformed(m)
+	}
 	newPeers := gossip.Peers
 	changed := false
-	err := p.parentCluster.ParseNewValues(gossip.Values)
+	//Recent events ride along with gossip to reach peers the fanout missed
+	for _, event := range gossip.Events {
+		p.parentCluster.ReceiveEvent(event)
+	}
+	err := p.parentCluster.MergeKeyring(gossip.Keyring)
+	if err != nil {
+		return err
+	}
+	//Revocations apply before new peers are checked against them
+	err = p.parentCluster.UpdateRevocationList(gossip.Revocations)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
+	p.parentCluster.LastSeenPeerMutex.RLock()
+	departed := make(map[string]bool)
+	for i := range newPeers {
+		_, departed[newPeers[i].ID] = p.parentCluster.DepartedPeers[newPeers[i].ID]
+	}
+	p.parentCluster.LastSeenPeerMutex.RUnlock()
 	p.parentCluster.PeersMutex.Lock()
-	for i := 0; i < len(newPeers); i++ {
-		if p.parentCluster.Peers[newPeers[i].ID] == nil {
-			p.parentCluster.Peers[newPeers[i].ID] = &newPeers[i]
-			p.parentCluster.PeerIDs = append(p.parentCluster.PeerIDs, newPeers[i].ID)
-			changed = true
+	//The seed signed this peer's admission, which is passed on with its entry
+	local := p.parentCluster.Peers[p.ID]
+	for i := range newPeers {
+		if Vouched && newPeers[i].ID == p.ID && local != nil && bytes.Equal(newPeers[i].PublicKey, local.PublicKey) {
+			local.Admitter = newPeers[i].Admitter
+			local.Admission = newPeers[i].Admission
 		}
 	}
+	//A peer may be admitted by another peer in the same list, so passes repeat
+	//until no more peers can be added
+	for added := true; added; {
+		added = false
+		for i := 0; i < len(newPeers); i++ {
+			if newPeers[i].Suite != p.parentCluster.Suite.Name() {
+				continue
+			}
+			if p.parentCluster.Peers[newPeers[i].ID] != nil || departed[newPeers[i].ID] {
+				continue
+			}
+			if p.parentCluster.bindsKey(newPeers[i], m.Header.From, Vouched) && p.parentCluster.AdmitPeer(&newPeers[i]) == nil {
+				p.parentCluster.addPeer(&newPeers[i])
+				changed = true
+				added = true
+			}
+		}
+	}
+	sender := p.parentCluster.Peers[m.Header.From]
 	p.parentCluster.PeersMutex.Unlock()
+	p.parentCluster.MergeBans(gossip.Bans)
+	//Subscriptions are checked against their subscribers' keys
+	p.parentCluster.MergeSubscriptions(gossip.Subscriptions)
+	//Values are checked against their authors' keys, so peers are merged
+	//first. Those that fail are counted and skipped without blaming the relay,
+	//which may know an author by a key this peer never agreed to
+	p.parentCluster.ParseNewValues(gossip.Values)
 	if m.Header.ID == 3 {
+		//The peer sent its list because the digests differed. If they still
+		//differ this peer knows peers the other does not, so it sends them back
+		if gossip.Peers != nil && sender != nil && p.parentCluster.PeerDigest() != gossip.PeerDigest {
+			M := Message{Header: Header{ID: 1, From: p.ID}, Body: Body{Content: p.parentCluster.GossipState(sender.ID)}}
+			return p.SendMessage(*sender, M)
+		}
 		return nil
 	}
 	if m.Header.ID == 2 {
-		peers := make([]Peer, 0)
-		p.parentCluster.PeersMutex.RLock()
-		for _, peer := range p.parentCluster.Peers {
-			peers = append(peers, Peer{ID: peer.ID, IP: peer.IP, Port: peer.Port})
+		if sender == nil {
+			return errors.New("Unknown peer")
 		}
-		p.parentCluster.ValuesMutex.RLock()
-		M := Message{Header: Header{ID: 3, From: p.ID}, Body: Body{Content: Gossip{Peers: peers, Values: p.parentCluster.Values}}}
-		p.parentCluster.ValuesMutex.RUnlock()
-		p.SendMessage(*p.parentCluster.Peers[m.Header.From], M)
-		p.parentCluster.PeersMutex.RUnlock()
-		return nil
+		//Only send the peer list when the push shows the peers differ
+		state := p.parentCluster.GossipDigest(sender.ID)
+		if gossip.PeerDigest != state.PeerDigest {
+			state.Peers = p.parentCluster.PeerList()
+		}
+		M := Message{Header: Header{ID: 3, From: p.ID}, Body: Body{Content: state}}
+		return p.SendMessage(*sender, M)
 	}
 	if changed {
-		sentIDs := make(map[int]bool)
-		peersToShare := len(p.parentCluster.PeerIDs) - 1
-		if peersToShare > 5 {
-			peersToShare = 5
+		//Spread new peers to up to five random peers
+		for _, peer := range p.parentCluster.RandomPeers(5) {
+			M := Message{Header: Header{ID: 1, From: p.ID}, Body: Body{Content: p.parentCluster.GossipState(peer.ID)}}
+			p.SendMessage(peer, M)
 		}
-		for i := 0; i < peersToShare; i++ {
-			indexID := 0
-			for {
-				index, err := rand.Int(rand.Reader, big.NewInt(int64(len(p.parentCluster.PeerIDs)-1)))
-				indexID = int(index.Int64())
-				if err != nil {
-					return err
-				}
-				if p.parentCluster.PeerIDs[indexID] != p.ID && sentIDs[indexID] == false {
-					sentIDs[indexID] = true
-					break
-				}
-			}
-			peers := make([]Peer, 0)
-			p.parentCluster.PeersMutex.RLock()
-			for _, peer := range p.parentCluster.Peers {
-				peers = append(peers, Peer{ID: peer.ID, IP: peer.IP, Port: peer.Port})
-			}
-			p.parentCluster.ValuesMutex.RLock()
-			M := Message{Header: Header{ID: 1, From: p.ID}, Body: Body{Content: Gossip{Peers: peers, Values: p.parentCluster.Values}}}
-			p.parentCluster.ValuesMutex.RUnlock()
-			p.SendMessage(*p.parentCluster.Peers[p.parentCluster.PeerIDs[indexID]], M)
-			p.parentCluster.PeersMutex.RUnlock()
+	}
+	return nil
+}
 
-		}
+func (p *Peer) HandleDirectMessage(m Message) error {
+	//Ordered messages are delivered in the order the sender sent them
+	if m.Header.Order != 0 {
+		return p.DeliverInOrder(m)
+	}
+	return p.deliverDirectMessage(m)
+}
+
+func (p *Peer) deliverDirectMessage(m Message) error {
+	directMessage, ok := m.Body.Content.(DirectMessage)
+	if !ok {
+		return p.malformed(m)
+	}
+	//Find the handler registered for this message type
+	p.parentCluster.HandlersMutex.RLock()
+	handler := p.parentCluster.Handlers[directMessage.Type]
+	p.parentCluster.HandlersMutex.RUnlock()
+	if handler == nil {
+		return errors.New("No handler registered for message type")
+	}
+	if !p.parentCluster.RunHandler(m.Header.From, func() {
+		handler(m.Header.From, directMessage.Payload)
+	}) {
+		return errors.New("Handler queue full")
 	}
 	return nil
 }
 
-func (p *Peer) StartGossip() error {
-	go func() {
-		for {
-			if p.Stopped == true {
-				break
+func (p *Peer) HandleRPCRequest(m Message) error {
+	request, ok := m.Body.Content.(RPCRequest)
+	if !ok {
+		return p.malformed(m)
+	}
+	p.parentCluster.PeersMutex.RLock()
+	caller := p.parentCluster.Peers[m.Header.From]
+	p.parentCluster.PeersMutex.RUnlock()
+	if caller == nil {
+		return errors.New("Unknown peer")
+	}
+	//Find the handler registered for this method
+	p.parentCluster.MethodsMutex.RLock()
+	handler := p.parentCluster.Methods[request.Method]
+	p.parentCluster.MethodsMutex.RUnlock()
+	//The handler may call back into the caller, so it must not hold up the
+	//receive worker that delivers the reply
+	p.parentCluster.RunDetached(func() {
+		response := RPCResponse{}
+		if handler == nil {
+			response.Error = "Unknown method " + request.Method
+		} else {
+			payload, err := handler(m.Header.From, request.Payload)
+			if err != nil {
+				response.Error = err.Error()
 			}
-			if len(p.parentCluster.PeerIDs) != 1 {
-				indexID := 0
-				for {
-
-					index, _ := rand.Int(rand.Reader, big.NewInt(int64(len(p.parentCluster.PeerIDs)-1)))
-					indexID = int(index.Int64())
-
-					if p.parentCluster.PeerIDs[indexID] != p.ID {
-						break
-					}
-				}
-				peers := make([]Peer, 0)
-				p.parentCluster.PeersMutex.RLock()
-				for _, peer := range p.parentCluster.Peers {
-					peers = append(peers, Peer{ID: peer.ID, IP: peer.IP, Port: peer.Port})
-				}
-				p.parentCluster.PeersMutex.RUnlock()
-				p.parentCluster.ValuesMutex.Lock()
-				M := Message{Header: Header{ID: 2, From: p.ID}, Body: Body{Content: Gossip{Peers: peers, Values: p.parentCluster.Values}}}
-				p.parentCluster.ValuesMutex.Unlock()
-				p.parentCluster.PeersMutex.RLock()
-				p.SendMessage(*p.parentCluster.Peers[p.parentCluster.PeerIDs[indexID]], M)
-				p.parentCluster.PeersMutex.RUnlock()
+			response.Payload = payload
+		}
+		//Reply using the caller's correlation ID so the response can be matched
+		M := Message{Header: Header{ID: 6, From: p.ID, CorrelationID: m.Header.CorrelationID}, Body: Body{Content: response}}
+		p.SendMessage(*caller, M)
+	})
+	return nil
+}
 
-			}
-			p.parentCluster.AgeOutPeers()
+func (p *Peer) HandleRPCResponse(m Message) error {
+	response, ok := m.Body.Content.(RPCResponse)
+	if !ok {
+		return p.malformed(m)
+	}
+	p.parentCluster.PendingCallsMutex.Lock()
+	pending := p.parentCluster.PendingCalls[m.Header.CorrelationID]
+	delete(p.parentCluster.PendingCalls, m.Header.CorrelationID)
+	p.parentCluster.PendingCallsMutex.Unlock()
+	if pending == nil {
+		return errors.New("No pending call for correlation ID")
+	}
+	pending <- response
+	return nil
+}
 
-			time.Sleep(time.Millisecond * 500)
-		}
-	}()
+func (p *Peer) StartGossip() error {
+	p.parentCluster.Clock.AfterFunc(0, p.Gossip)
 	return nil
 }
 
+func (p *Peer) Gossip() {
+	if p.Stopped() {
+		return
+	}
+	peers := p.parentCluster.RandomPeers(1)
+	if len(peers) == 1 {
+		M := Message{Header: Header{ID: 2, From: p.ID}, Body: Body{Content: p.parentCluster.GossipDigest(peers[0].ID)}}
+		p.SendMessage(peers[0], M)
+	}
+	p.parentCluster.AgeOutPeers()
+	p.parentCluster.ExpireFragments()
+	p.parentCluster.PruneRateBuckets()
+	p.parentCluster.ExpireReplays()
+	p.parentCluster.ExpireSessions()
+	p.parentCluster.CheckCertificates()
+	p.parentCluster.ExpireInvites()
+	p.parentCluster.ExpireBans()
+
+	p.parentCluster.Clock.AfterFunc(p.parentCluster.GossipInterval, p.Gossip)
+}
+
 // func (p *Peer) HandleFileMessage(c net.Conn) error {
 // 	message := make([]byte, 2048)
 // 	_, err := c.Read(message)
@@ -354,7 +693,7 @@ func (p *Peer) StartGossip() error {
 // 	}
 
 // 	p.parentCluster.LastSeenPeerMutex.Lock()
-// 	p.parentCluster.LastSeenPeer[decryptedMessage.Header.From] = time.Now().UTC().Unix()
+// 	p.parentCluster.LastSeenPeer[decryptedMessage.Header.From] = p.parentCluster.Clock.Now().UTC().Unix()
 // 	p.parentCluster.LastSeenPeerMutex.Unlock()
 // 	chunkRequest := decryptedMessage.Body.Content.(ChunkRequest)
 // 	fileID := chunkRequest.ID
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestStartListening(t *testing.T) {
@@ -39,3 +42,109 @@ func TestInitializeRSAUtil(t *testing.T) {
 	}
 
 }
+
+func TestIdentityKeys(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 3; i++ {
+		S.AddNode()
+	}
+	S.Run(time.Second * 5)
+	C, C1, C2 := S.Clusters[0], S.Clusters[1], S.Clusters[2]
+	for _, peer := range C.PeerList() {
+		if peer.PublicKey == nil {
+			t.Error(errors.New("Peer was learned without its public key"))
+		}
+	}
+	if bytes.Equal(C1.LocalPeer.PublicKey, C2.LocalPeer.PublicKey) {
+		t.Error(errors.New("Peers should have their own identity keys"))
+	}
+
+	//A peer can not sign messages as another peer
+	target := *C.Peers[C.LocalPeer.ID]
+	M := Message{Header: Header{ID: 4, From: C1.LocalPeer.ID}, Body: Body{Content: DirectMessage{Type: "greeting"}}}
+	messageBytes, _ := C2.LocalPeer.EncodeMessage(target, M)
+	if C.LocalPeer.HandleMessage(messageBytes) == nil {
+		t.Error(errors.New("Message signed by another peer should be rejected"))
+	}
+	//The cluster key only admits new peers
+	messageBytes, _ = C2.LocalPeer.EncodeAdmissionMessage(M)
+	if C.LocalPeer.HandleMessage(messageBytes) == nil {
+		t.Error(errors.New("Cluster key should not be accepted for direct messages"))
+	}
+	//Nor can it replace the key of a known peer
+	impostor := Peer{ID: C1.LocalPeer.ID, IP: C1.LocalPeer.IP, Port: 1, Suite: "rsa", PublicKey: C2.LocalPeer.PublicKey}
+	messageBytes, _ = C2.LocalPeer.EncodeAdmissionMessage(Message{Header: Header{ID: 0, From: impostor.ID}, Body: Body{Content: impostor}})
+	C.LocalPeer.HandleMessage(messageBytes)
+	if !bytes.Equal(C.Peers[C1.LocalPeer.ID].PublicKey, C1.LocalPeer.PublicKey) {
+		t.Error(errors.New("Bootstrap should not replace a known peer's key"))
+	}
+	//Nor push state to a member that is not waiting on its bootstrap
+	state := Gossip{Bans: []Ban{{Target: C1.LocalPeer.ID, Expires: S.Clock.Now().Add(time.Minute).UnixNano()}}}
+	messageBytes, _ = C2.LocalPeer.EncodeAdmissionMessage(Message{Header: Header{ID: 1, From: C2.LocalPeer.ID}, Body: Body{Content: state}})
+	if C.LocalPeer.HandleMessage(messageBytes) == nil || C.IsBanned(C1.LocalPeer.ID) {
+		t.Error(errors.New("Cluster key should only carry state to a joining node"))
+	}
+	S.Shutdown()
+}
+
+func TestRetainedKey(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 3; i++ {
+		S.AddNode()
+	}
+	S.Run(time.Second * 5)
+	C, relay, departed := S.Clusters[0], S.Clusters[1], S.Clusters[2]
+	//A departed peer's ID keeps its key
+	C.PeersMutex.Lock()
+	C.removePeer(departed.LocalPeer.ID)
+	C.PeersMutex.Unlock()
+	imposter := relay.PeerList()[0]
+	imposter.ID = departed.LocalPeer.ID
+	gossip := Message{Header: Header{ID: 2, From: relay.LocalPeer.ID}, Body: Body{Content: Gossip{Peers: []Peer{imposter}}}}
+	C.LocalPeer.HandleNewPeers(gossip)
+	if C.Peers[departed.LocalPeer.ID] != nil || !bytes.Equal(C.AuthorKeys[departed.LocalPeer.ID], departed.LocalPeer.PublicKey) {
+		t.Error(errors.New("Departed peer's key should not be replaced"))
+	}
+	S.Shutdown()
+}
+
+func TestKeyBinding(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 4; i++ {
+		S.AddNode()
+	}
+	S.Run(time.Second * 5)
+	C, relay, joined := S.Clusters[0], S.Clusters[1], S.Clusters[3]
+	//Peers the seed admitted are learned from any relay
+	for _, c := range S.Clusters {
+		if len(c.Peers) != 4 {
+			t.Error(errors.New("Admitted peers were not learned"))
+		}
+	}
+	if C.Peers[joined.LocalPeer.ID].Admitter != C.LocalPeer.ID {
+		t.Error(errors.New("Admission should name the seed"))
+	}
+
+	//A relay can not bind an ID to a key on its own word, nor reuse another
+	//peer's admission
+	intruder := *relay.Peers[joined.LocalPeer.ID]
+	intruder.ID = "intruder"
+	gossip := Message{Header: Header{ID: 2, From: relay.LocalPeer.ID}, Body: Body{Content: Gossip{Peers: []Peer{intruder}}}}
+	C.LocalPeer.HandleNewPeers(gossip)
+	if C.Peers["intruder"] != nil {
+		t.Error(errors.New("Relayed binding without an admission should be refused"))
+	}
+	S.Shutdown()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Number of topic message IDs remembered for deduplication
+const seenTopicMessagesSize = 4096
+
+// TopicSubscription is the set of topics one peer subscribes to, signed by
+// that peer so relays can carry it but not change it
+type TopicSubscription struct {
+	Topics    []string
+	Version   uint64
+	Signature []byte
+}
+
+// signedSubscription is what a subscriber signs
+type signedSubscription struct {
+	Peer    string
+	Topics  []string
+	Version uint64
+}
+
+func (s TopicSubscription) signedBytes(PeerID string) ([]byte, error) {
+	subscriptionBytes := bytes.Buffer{}
+	err := gob.NewEncoder(&subscriptionBytes).Encode(signedSubscription{Peer: PeerID, Topics: s.Topics, Version: s.Version})
+	return subscriptionBytes.Bytes(), err
+}
+
+type TopicMessage struct {
+	ID      string
+	Topic   string
+	Payload []byte
+	Origin  string
+}
+
+type TopicHandler func(Message TopicMessage)
+
+// Subscribe delivers messages published to the topic to the handler and
+// advertises the subscription to the rest of the cluster through gossip
+func (c *Cluster) Subscribe(Topic string, Handler TopicHandler) error {
+	if Handler == nil {
+		return errors.New("Handler can not be nil")
+	}
+	c.TopicsMutex.Lock()
+	c.Topics[Topic] = Handler
+	c.updateLocalSubscription()
+	c.TopicsMutex.Unlock()
+	return nil
+}
+
+func (c *Cluster) Unsubscribe(Topic string) error {
+	c.TopicsMutex.Lock()
+	delete(c.Topics, Topic)
+	c.updateLocalSubscription()
+	c.TopicsMutex.Unlock()
+	return nil
+}
+
+func (c *Cluster) updateLocalSubscription() {
+	topics := make([]string, 0, len(c.Topics))
+	for topic := range c.Topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	subscription := TopicSubscription{Topics: topics, Version: c.Subscriptions[c.LocalPeer.ID].Version + 1}
+	data, err := subscription.signedBytes(c.LocalPeer.ID)
+	if err == nil {
+		//Left unsigned if signing fails, which other peers refuse
+		subscription.Signature, _ = c.Suite.Sign(c.LocalPeer.identity, data)
+	}
+	c.Subscriptions[c.LocalPeer.ID] = subscription
+}
+
+func (c *Cluster) SubscriptionList() map[string]TopicSubscription {
+	c.TopicsMutex.Lock()
+	defer c.TopicsMutex.Unlock()
+	subscriptions := make(map[string]TopicSubscription)
+	for id, subscription := range c.Subscriptions {
+		subscriptions[id] = subscription
+	}
+	return subscriptions
+}
+
+// MergeSubscriptions keeps the newest version of every known peer's
+// subscriptions, taking only those signed by the subscriber itself
+func (c *Cluster) MergeSubscriptions(Subscriptions map[string]TopicSubscription) {
+	for id, subscription := range Subscriptions {
+		//Only this peer changes its own subscriptions
+		if id == c.LocalPeer.ID {
+			continue
+		}
+		c.TopicsMutex.Lock()
+		newer := subscription.Version > c.Subscriptions[id].Version
+		c.TopicsMutex.Unlock()
+		if !newer || c.verifySubscription(id, subscription) != nil {
+			continue
+		}
+		c.TopicsMutex.Lock()
+		if subscription.Version > c.Subscriptions[id].Version {
+			c.Subscriptions[id] = subscription
+		}
+		c.TopicsMutex.Unlock()
+	}
+}
+
+func (c *Cluster) verifySubscription(PeerID string, Subscription TopicSubscription) error {
+	c.PeersMutex.RLock()
+	subscriber := c.Peers[PeerID]
+	c.PeersMutex.RUnlock()
+	if subscriber == nil || subscriber.PublicKey == nil {
+		return errors.New("Unknown subscriber")
+	}
+	data, err := Subscription.signedBytes(PeerID)
+	if err != nil {
+		return err
+	}
+	return c.Suite.Verify(subscriber.PublicKey, data, Subscription.Signature)
+}
+
+// DropSubscriptions forgets the subscriptions of a peer that left or
+// rejoined, as a rejoined peer numbers its versions from the start again
+func (c *Cluster) DropSubscriptions(PeerID string) {
+	c.TopicsMutex.Lock()
+	delete(c.Subscriptions, PeerID)
+	c.TopicsMutex.Unlock()
+}
+
+// Subscribers returns known peers other than this one subscribed to the topic
+func (c *Cluster) Subscribers(Topic string) []Peer {
+	c.TopicsMutex.Lock()
+	ids := make([]string, 0)
+	for id, subscription := range c.Subscriptions {
+		if id == c.LocalPeer.ID {
+			continue
+		}
+		for _, topic := range subscription.Topics {
+			if topic == Topic {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	c.TopicsMutex.Unlock()
+	sort.Strings(ids)
+	peers := make([]Peer, 0, len(ids))
+	c.PeersMutex.RLock()
+	for _, id := range ids {
+		if c.Peers[id] != nil {
+			peers = append(peers, *c.Peers[id])
+		}
+	}
+	c.PeersMutex.RUnlock()
+	return peers
+}
+
+func (c *Cluster) Publish(Topic string, Payload []byte) error {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+	message := TopicMessage{ID: id.String(), Topic: Topic, Payload: Payload, Origin: c.LocalPeer.ID}
+	c.ReceiveTopicMessage(message)
+	return c.LocalPeer.SendTopicMessage(message)
+}
+
+// ReceiveTopicMessage delivers a message to the local subscriber, reporting
+// false when the message was already seen
+func (c *Cluster) ReceiveTopicMessage(Message TopicMessage) bool {
+	c.TopicsMutex.Lock()
+	if c.SeenTopicMessages[Message.ID] {
+		c.TopicsMutex.Unlock()
+		return false
+	}
+	c.SeenTopicMessages[Message.ID] = true
+	c.SeenTopicOrder = append(c.SeenTopicOrder, Message.ID)
+	if len(c.SeenTopicOrder) > seenTopicMessagesSize {
+		delete(c.SeenTopicMessages, c.SeenTopicOrder[0])
+		c.SeenTopicOrder = c.SeenTopicOrder[1:]
+	}
+	handler := c.Topics[Message.Topic]
+	c.TopicsMutex.Unlock()
+	if handler != nil {
+		handler(Message)
+	}
+	return true
+}
+
+// SendTopicMessage sends a message straight to every known subscriber, so
+// delivery does not depend on which peers relay it
+func (p *Peer) SendTopicMessage(message TopicMessage) error {
+	M := Message{Header: Header{ID: 11, From: p.ID}, Body: Body{Content: message}}
+	for _, peer := range p.parentCluster.Subscribers(message.Topic) {
+		p.SendMessage(peer, M)
+	}
+	return nil
+}
+
+func (p *Peer) HandleTopicMessage(m Message) error {
+	message, ok := m.Body.Content.(TopicMessage)
+	if !ok {
+		return p.malformed(m)
+	}
+	//Messages come from their origin, so there is nothing to forward
+	if message.Origin != m.Header.From {
+		return p.malformed(m)
+	}
+	p.parentCluster.ReceiveTopicMessage(message)
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPublish(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	received := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		C := &Cluster{}
+		S.AddCluster(C)
+		if i%2 == 1 {
+			C.Subscribe("news", func(Message TopicMessage) {
+				received[C.LocalPeer.ID]++
+			})
+		}
+	}
+	S.Run(time.Second * 10)
+	err := S.Clusters[0].Publish("news", []byte("Hello"))
+	if err != nil {
+		t.Error(err)
+	}
+	S.Run(time.Second)
+	for i, C := range S.Clusters {
+		if i%2 == 1 && received[C.LocalPeer.ID] != 1 {
+			t.Error(errors.New("Subscriber did not receive the message exactly once"))
+		}
+		if i%2 == 0 && i != 0 && len(C.SeenTopicOrder) != 0 {
+			t.Error(errors.New("Message reached a peer not subscribed to the topic"))
+		}
+	}
+
+	S.Clusters[1].Unsubscribe("news")
+	S.Run(time.Second * 10)
+	for _, peer := range S.Clusters[0].Subscribers("news") {
+		if peer.ID == S.Clusters[1].LocalPeer.ID {
+			t.Error(errors.New("Unsubscribe did not propagate"))
+		}
+	}
+	//A relay can not subscribe or unsubscribe another peer
+	C := S.Clusters[2]
+	forged := map[string]TopicSubscription{S.Clusters[3].LocalPeer.ID: {Topics: []string{"forged"}, Version: 100}}
+	C.MergeSubscriptions(forged)
+	if len(C.Subscribers("forged")) != 0 || C.SubscriptionList()[S.Clusters[3].LocalPeer.ID].Version == 100 {
+		t.Error(errors.New("Forged subscription should be refused"))
+	}
+
+	//A peer's subscriptions are forgotten once it ages out
+	S.Clusters[3].Shutdown()
+	S.Run(C.PeerTimeout * 2)
+	if _, ok := C.SubscriptionList()[S.Clusters[3].LocalPeer.ID]; ok {
+		t.Error(errors.New("Departed peer's subscriptions should be dropped"))
+	}
+	S.Shutdown()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type QueryFilter struct {
+	//Only peers with one of these IDs, or any peer when empty
+	PeerIDs []string
+	//Tag names mapped to regular expressions the peer's tag must fully match
+	Tags map[string]string
+}
+
+type Query struct {
+	ID      string
+	Name    string
+	Payload []byte
+	Origin  string
+	Filter  QueryFilter
+}
+
+type QueryReply struct {
+	QueryID string
+	From    string
+	Payload []byte
+	Error   string
+	Ack     bool
+}
+
+type QueryHandler func(Query Query) ([]byte, error)
+
+// QueryResponse streams replies to a query until its context is done
+type QueryResponse struct {
+	Responses chan QueryReply
+	acks      map[string]bool
+	replies   map[string]bool
+	closed    bool
+	mutex     *sync.Mutex
+}
+
+func (r *QueryResponse) Acks() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.acks)
+}
+
+func (r *QueryResponse) Replies() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.replies)
+}
+
+func (r *QueryResponse) receive(Reply QueryReply) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return
+	}
+	if Reply.Ack {
+		r.acks[Reply.From] = true
+		return
+	}
+	//Each peer replies once, retransmissions are ignored
+	if r.replies[Reply.From] {
+		return
+	}
+	r.replies[Reply.From] = true
+	r.Responses <- Reply
+}
+
+func (r *QueryResponse) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.Responses)
+	}
+}
+
+// Matches reports whether a peer is selected by the filter
+func (f QueryFilter) Matches(p Peer) bool {
+	if len(f.PeerIDs) > 0 {
+		found := false
+		for _, id := range f.PeerIDs {
+			if id == p.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for tag, expression := range f.Tags {
+		value, ok := p.Tags[tag]
+		if !ok {
+			return false
+		}
+		matched, err := regexp.MatchString("^(?:"+expression+")$", value)
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Cluster) RegisterQuery(Name string, Handler QueryHandler) error {
+	if Handler == nil {
+		return errors.New("Handler can not be nil")
+	}
+	c.QueriesMutex.Lock()
+	c.QueryHandlers[Name] = Handler
+	c.QueriesMutex.Unlock()
+	return nil
+}
+
+// Query asks every peer matching the filter, including this one, to run the
+// named query handler. Replies stream in until the context is done
+func (c *Cluster) Query(ctx context.Context, Name string, Payload []byte, Filter QueryFilter) (*QueryResponse, error) {
+	for _, expression := range Filter.Tags {
+		_, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, err
+		}
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	query := Query{ID: id.String(), Name: Name, Payload: Payload, Origin: c.LocalPeer.ID, Filter: Filter}
+	targets := make([]Peer, 0)
+	for _, peer := range c.PeerList() {
+		if Filter.Matches(peer) {
+			targets = append(targets, peer)
+		}
+	}
+	//Buffered so every target can reply without blocking
+	response := &QueryResponse{Responses: make(chan QueryReply, len(targets)), acks: make(map[string]bool), replies: make(map[string]bool), mutex: new(sync.Mutex)}
+	c.QueriesMutex.Lock()
+	c.PendingQueries[query.ID] = response
+	c.QueriesMutex.Unlock()
+	go func() {
+		<-ctx.Done()
+		c.QueriesMutex.Lock()
+		delete(c.PendingQueries, query.ID)
+		c.QueriesMutex.Unlock()
+		response.close()
+	}()
+
+	M := Message{Header: Header{ID: 9, From: c.LocalPeer.ID}, Body: Body{Content: query}}
+	for _, peer := range targets {
+		if peer.ID == c.LocalPeer.ID {
+			for _, reply := range c.AnswerQuery(query) {
+				response.receive(reply)
+			}
+			continue
+		}
+		c.LocalPeer.SendMessage(peer, M)
+	}
+	return response, nil
+}
+
+// AnswerQuery acknowledges a query and runs its handler if one is registered
+func (c *Cluster) AnswerQuery(Query Query) []QueryReply {
+	replies := []QueryReply{{QueryID: Query.ID, From: c.LocalPeer.ID, Ack: true}}
+	c.QueriesMutex.Lock()
+	handler := c.QueryHandlers[Query.Name]
+	c.QueriesMutex.Unlock()
+	if handler == nil {
+		return replies
+	}
+	reply := QueryReply{QueryID: Query.ID, From: c.LocalPeer.ID}
+	payload, err := handler(Query)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	reply.Payload = payload
+	return append(replies, reply)
+}
+
+func (p *Peer) HandleQuery(m Message) error {
+	query, ok := m.Body.Content.(Query)
+	if !ok {
+		return p.malformed(m)
+	}
+	p.parentCluster.PeersMutex.RLock()
+	origin := p.parentCluster.Peers[query.Origin]
+	p.parentCluster.PeersMutex.RUnlock()
+	if origin == nil {
+		return errors.New("Unknown peer")
+	}
+	//The origin filtered on what it knew, check against our own tags too
+	if !query.Filter.Matches(Peer{ID: p.ID, Tags: p.Tags}) {
+		return nil
+	}
+	//Replies go straight back to the origin, once the handler has run
+	p.parentCluster.RunDetached(func() {
+		for _, reply := range p.parentCluster.AnswerQuery(query) {
+			M := Message{Header: Header{ID: 10, From: p.ID}, Body: Body{Content: reply}}
+			if p.SendMessage(*origin, M) != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (p *Peer) HandleQueryReply(m Message) error {
+	reply, ok := m.Body.Content.(QueryReply)
+	if !ok {
+		return p.malformed(m)
+	}
+	//Replies are attributed to the verified sender
+	reply.From = m.Header.From
+	p.parentCluster.QueriesMutex.Lock()
+	response := p.parentCluster.PendingQueries[reply.QueryID]
+	p.parentCluster.QueriesMutex.Unlock()
+	if response == nil {
+		return nil
+	}
+	response.receive(reply)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueryFilter(t *testing.T) {
+	P := Peer{ID: "1", Tags: map[string]string{"role": "web", "zone": "eu-west"}}
+	if !(QueryFilter{}).Matches(P) {
+		t.Error(errors.New("Empty filter should match every peer"))
+	}
+	if !(QueryFilter{Tags: map[string]string{"zone": "eu-.*"}}).Matches(P) {
+		t.Error(errors.New("Tag expression should match"))
+	}
+	if (QueryFilter{Tags: map[string]string{"zone": "eu"}}).Matches(P) {
+		t.Error(errors.New("Tag expression should match the whole value"))
+	}
+	if (QueryFilter{Tags: map[string]string{"disk": ".*"}}).Matches(P) {
+		t.Error(errors.New("Missing tag should not match"))
+	}
+	if (QueryFilter{PeerIDs: []string{"2"}}).Matches(P) {
+		t.Error(errors.New("Peer ID filter should not match other peers"))
+	}
+}
+
+func TestQuery(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 4; i++ {
+		C := &Cluster{Tags: map[string]string{"role": "db"}}
+		if i%2 == 0 {
+			C.Tags["role"] = "web"
+		}
+		S.AddCluster(C)
+		C.RegisterQuery("has-file", func(Query Query) ([]byte, error) {
+			return []byte(C.LocalPeer.ID), nil
+		})
+	}
+	S.Run(time.Second * 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	response, err := S.Clusters[1].Query(ctx, "has-file", []byte("x"), QueryFilter{Tags: map[string]string{"role": "web"}})
+	if err != nil {
+		t.Error(err)
+	}
+	S.Run(time.Second)
+	if response.Acks() != 2 || response.Replies() != 2 {
+		t.Error(errors.New("Query did not reach only the filtered peers"))
+	}
+	cancel()
+	replies := 0
+	for reply := range response.Responses {
+		if string(reply.Payload) != reply.From {
+			t.Error(errors.New("Reply did not come from the answering peer"))
+		}
+		replies++
+	}
+	if replies != 2 {
+		t.Error(errors.New("Responses were not streamed"))
+	}
+	S.Shutdown()
+}
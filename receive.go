@@ -0,0 +1,227 @@
+package main
+
+import (
+	"hash/fnv"
+	"net"
+	"time"
+)
+
+// Reasons a received packet or stream message was dropped
+const (
+	DropQueueFull    = "queue_full"
+	DropRateLimited  = "rate_limited"
+	DropHandlersBusy = "handlers_busy"
+)
+
+// RateBucket is a token bucket limiting how fast one address can send
+type RateBucket struct {
+	Tokens float64
+	Last   time.Time
+}
+
+// HandlerQueue holds the user handlers waiting to run for one peer
+type HandlerQueue struct {
+	Jobs    []func()
+	Running bool
+}
+
+// StartWorkers starts the workers that handle received packets. Each source
+// address always maps to the same worker so its packets are handled in order
+func (c *Cluster) StartWorkers() {
+	c.ReceiveQueues = make([]chan func(), c.ReceiveWorkers)
+	stop := make(chan bool)
+	c.stopWorkers = stop
+	for i := range c.ReceiveQueues {
+		queue := make(chan func(), c.ReceiveQueueSize)
+		c.ReceiveQueues[i] = queue
+		go func() {
+			for {
+				select {
+				case f := <-queue:
+					f()
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (c *Cluster) StopWorkers() {
+	if c.stopWorkers == nil {
+		return
+	}
+	select {
+	case <-c.stopWorkers:
+		//Already stopped
+	default:
+		close(c.stopWorkers)
+	}
+}
+
+// Enqueue queues work received from an address, dropping it if the address
+// is over its rate limit or its worker is backed up
+func (c *Cluster) Enqueue(Address string, f func()) bool {
+	if c.IsBanned(Address) {
+		c.CountDrop(DropBanned)
+		return false
+	}
+	host := sourceHost(Address)
+	if !c.AllowReceive(host) {
+		c.CountDrop(DropRateLimited)
+		c.Penalize(Address, "", PenaltyRateLimited, DropRateLimited)
+		return false
+	}
+	//The simulator handles messages on its event loop so runs are repeatable
+	if c.Synchronous {
+		f()
+		return true
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(host))
+	select {
+	case c.ReceiveQueues[hash.Sum32()%uint32(len(c.ReceiveQueues))] <- f:
+		return true
+	default:
+		c.CountDrop(DropQueueFull)
+		return false
+	}
+}
+
+// RunHandler runs a user handler for messages from a peer off the receive
+// worker, so a slow handler only holds up that peer's handlers. Handlers for
+// one peer run one at a time in the order they were queued
+func (c *Cluster) RunHandler(From string, f func()) bool {
+	if c.Synchronous {
+		f()
+		return true
+	}
+	c.ReceiveMutex.Lock()
+	queue := c.HandlerQueues[From]
+	if queue == nil {
+		queue = &HandlerQueue{}
+		c.HandlerQueues[From] = queue
+	}
+	if len(queue.Jobs) >= c.ReceiveQueueSize {
+		c.Drops[DropQueueFull]++
+		c.ReceiveMutex.Unlock()
+		return false
+	}
+	queue.Jobs = append(queue.Jobs, f)
+	if queue.Running {
+		c.ReceiveMutex.Unlock()
+		return true
+	}
+	queue.Running = true
+	c.ReceiveMutex.Unlock()
+	go func() {
+		for {
+			c.ReceiveMutex.Lock()
+			if len(queue.Jobs) == 0 {
+				delete(c.HandlerQueues, From)
+				c.ReceiveMutex.Unlock()
+				return
+			}
+			job := queue.Jobs[0]
+			queue.Jobs = queue.Jobs[1:]
+			c.ReceiveMutex.Unlock()
+			job()
+		}
+	}()
+	return true
+}
+
+// RunDetached runs work that may block, such as an RPC handler calling back into its
+// caller, on its own goroutine. At most MaxDetached run at once and work over
+// that is dropped. The simulator runs it in place
+func (c *Cluster) RunDetached(f func()) bool {
+	if c.Synchronous {
+		f()
+		return true
+	}
+	c.ReceiveMutex.Lock()
+	if c.Detached >= c.MaxDetached {
+		c.Drops[DropHandlersBusy]++
+		c.ReceiveMutex.Unlock()
+		return false
+	}
+	c.Detached++
+	c.ReceiveMutex.Unlock()
+	go func() {
+		defer func() {
+			c.ReceiveMutex.Lock()
+			c.Detached--
+			c.ReceiveMutex.Unlock()
+		}()
+		f()
+	}()
+	return true
+}
+
+// AllowReceive takes a token from the address's bucket if one is available
+func (c *Cluster) AllowReceive(Host string) bool {
+	if c.RateLimit <= 0 {
+		return true
+	}
+	now := c.Clock.Now()
+	c.ReceiveMutex.Lock()
+	defer c.ReceiveMutex.Unlock()
+	bucket := c.RateBuckets[Host]
+	if bucket == nil {
+		bucket = &RateBucket{Tokens: float64(c.RateBurst), Last: now}
+		c.RateBuckets[Host] = bucket
+	}
+	bucket.refill(now, c.RateLimit, c.RateBurst)
+	if bucket.Tokens < 1 {
+		return false
+	}
+	bucket.Tokens--
+	return true
+}
+
+func (b *RateBucket) refill(Now time.Time, Rate float64, Burst int) {
+	b.Tokens += Now.Sub(b.Last).Seconds() * Rate
+	if b.Tokens > float64(Burst) {
+		b.Tokens = float64(Burst)
+	}
+	b.Last = Now
+}
+
+// PruneRateBuckets forgets addresses whose buckets have refilled, so spoofed
+// source addresses can not grow the table without bound
+func (c *Cluster) PruneRateBuckets() {
+	now := c.Clock.Now()
+	c.ReceiveMutex.Lock()
+	defer c.ReceiveMutex.Unlock()
+	for host, bucket := range c.RateBuckets {
+		bucket.refill(now, c.RateLimit, c.RateBurst)
+		if bucket.Tokens >= float64(c.RateBurst) {
+			delete(c.RateBuckets, host)
+		}
+	}
+}
+
+func (c *Cluster) CountDrop(Reason string) {
+	c.ReceiveMutex.Lock()
+	c.Drops[Reason]++
+	c.ReceiveMutex.Unlock()
+}
+
+// DropCounts returns how many packets were dropped for each reason
+func (c *Cluster) DropCounts() map[string]uint64 {
+	c.ReceiveMutex.Lock()
+	defer c.ReceiveMutex.Unlock()
+	drops := make(map[string]uint64)
+	for reason, count := range c.Drops {
+		drops[reason] = count
+	}
+	return drops
+}
+
+func sourceHost(Address string) string {
+	host, _, err := net.SplitHostPort(Address)
+	if err != nil {
+		return Address
+	}
+	return host
+}
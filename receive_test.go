@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAllowReceive(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	C := Cluster{Clock: clock, RateLimit: 10, RateBurst: 5, RateBuckets: make(map[string]*RateBucket), Drops: make(map[string]uint64), ReceiveMutex: new(sync.Mutex)}
+	for i := 0; i < 5; i++ {
+		if !C.AllowReceive("10.0.0.1") {
+			t.Error(errors.New("Packets within the burst should be allowed"))
+		}
+	}
+	if C.AllowReceive("10.0.0.1") {
+		t.Error(errors.New("Packet over the burst should be limited"))
+	}
+	if !C.AllowReceive("10.0.0.2") {
+		t.Error(errors.New("Other addresses should not be limited"))
+	}
+	clock.Advance(time.Millisecond * 100)
+	if !C.AllowReceive("10.0.0.1") {
+		t.Error(errors.New("Bucket should refill over time"))
+	}
+	clock.Advance(time.Second)
+	C.PruneRateBuckets()
+	if len(C.RateBuckets) != 0 {
+		t.Error(errors.New("Refilled buckets should be pruned"))
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	C := Cluster{Clock: RealClock{}, ReceiveWorkers: 1, ReceiveQueueSize: 2, RateLimit: -1, Drops: make(map[string]uint64), ReceiveMutex: new(sync.Mutex), BanList: make(map[string]Ban), ReputationMutex: new(sync.Mutex)}
+	C.StartWorkers()
+	defer C.StopWorkers()
+	block := make(chan bool)
+	handled := make(chan int, 3)
+	C.Enqueue("10.0.0.1:1", func() {
+		<-block
+	})
+	//Give the worker time to pick up the blocking job
+	time.Sleep(time.Millisecond * 100)
+	for i := 0; i < 3; i++ {
+		i := i
+		C.Enqueue("10.0.0.1:1", func() {
+			handled <- i
+		})
+	}
+	if C.DropCounts()[DropQueueFull] != 1 {
+		t.Error(errors.New("Job over the queue size should be dropped"))
+	}
+	close(block)
+	for i := 0; i < 2; i++ {
+		select {
+		case n := <-handled:
+			if n != i {
+				t.Error(errors.New("Jobs from one address should run in order"))
+			}
+		case <-time.After(time.Second):
+			t.Error(errors.New("Queued job was not handled"))
+		}
+	}
+}
+
+func TestRunDetached(t *testing.T) {
+	C := Cluster{Clock: RealClock{}, MaxDetached: 1, Drops: make(map[string]uint64), ReceiveMutex: new(sync.Mutex)}
+	block := make(chan bool)
+	done := make(chan bool)
+	if !C.RunDetached(func() {
+		<-block
+		done <- true
+	}) {
+		t.Error(errors.New("Detached work under the limit should run"))
+	}
+	if C.RunDetached(func() {}) || C.DropCounts()[DropHandlersBusy] != 1 {
+		t.Error(errors.New("Detached work over the limit should be dropped"))
+	}
+	close(block)
+	<-done
+	//The slot is given back once the work returns
+	for i := 0; i < 100; i++ {
+		if C.RunDetached(func() {}) {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error(errors.New("Finished work should free its slot"))
+}
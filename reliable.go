@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Number of sequence numbers remembered per sender for duplicate suppression
+const sequenceWindowSize = 1024
+
+type SequenceWindow struct {
+	Highest uint64
+	Seen    map[uint64]bool
+}
+
+func NewSequenceWindow() *SequenceWindow {
+	return &SequenceWindow{Seen: make(map[uint64]bool)}
+}
+
+// Observe records a sequence number and reports whether it has not been seen before
+func (w *SequenceWindow) Observe(sequence uint64) bool {
+	//Anything older than the window is treated as a duplicate
+	if w.Highest > sequenceWindowSize && sequence <= w.Highest-sequenceWindowSize {
+		return false
+	}
+	if w.Seen[sequence] {
+		return false
+	}
+	w.Seen[sequence] = true
+	if sequence > w.Highest {
+		w.Highest = sequence
+		//Forget sequence numbers that slid out of the window
+		if w.Highest > sequenceWindowSize {
+			for seen := range w.Seen {
+				if seen <= w.Highest-sequenceWindowSize {
+					delete(w.Seen, seen)
+				}
+			}
+		}
+	}
+	return true
+}
+
+func (c *Cluster) ObserveSequence(PeerID string, Sequence uint64) bool {
+	c.ReliableMutex.Lock()
+	defer c.ReliableMutex.Unlock()
+	window := c.ReceivedSequences[PeerID]
+	if window == nil {
+		window = NewSequenceWindow()
+		c.ReceivedSequences[PeerID] = window
+	}
+	return window.Observe(Sequence)
+}
+
+// DropSequences forgets the sequence numbers seen from a peer that left or
+// rejoined, as a rejoined peer numbers its messages from the start again
+func (c *Cluster) DropSequences(PeerID string) {
+	c.ReliableMutex.Lock()
+	delete(c.ReceivedSequences, PeerID)
+	c.ReliableMutex.Unlock()
+}
+
+func pendingAckKey(PeerID string, Sequence uint64) string {
+	return PeerID + ":" + strconv.FormatUint(Sequence, 10)
+}
+
+func (p *Peer) SendReliableMessage(p2 Peer, m Message) error {
+	c := p.parentCluster
+	//Assign the next sequence number for this peer and register for its ack
+	acked := make(chan bool, 1)
+	c.ReliableMutex.Lock()
+	c.SendSequences[p2.ID]++
+	m.Header.Sequence = c.SendSequences[p2.ID]
+	key := pendingAckKey(p2.ID, m.Header.Sequence)
+	c.PendingAcks[key] = acked
+	c.ReliableMutex.Unlock()
+	defer func() {
+		c.ReliableMutex.Lock()
+		delete(c.PendingAcks, key)
+		c.ReliableMutex.Unlock()
+	}()
+
+	//Retransmissions keep the sequence number so the receiver can suppress duplicates
+	timeout := c.RetransmitTimeout
+	for attempt := 0; attempt <= c.MaxRetransmits; attempt++ {
+		err := p.SendMessage(p2, m)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-acked:
+			return nil
+		case <-c.Clock.After(timeout):
+			//Back off exponentially before retransmitting
+			timeout *= 2
+		}
+	}
+	return errors.New("Message was not acknowledged after " + strconv.Itoa(c.MaxRetransmits) + " retransmissions")
+}
+
+func (p *Peer) SendAck(m Message) error {
+	p.parentCluster.PeersMutex.RLock()
+	sender := p.parentCluster.Peers[m.Header.From]
+	p.parentCluster.PeersMutex.RUnlock()
+	if sender == nil {
+		return errors.New("Unknown peer")
+	}
+	M := Message{Header: Header{ID: 7, From: p.ID, Sequence: m.Header.Sequence}}
+	return p.SendMessage(*sender, M)
+}
+
+func (p *Peer) HandleAck(m Message) error {
+	p.parentCluster.ReliableMutex.Lock()
+	acked := p.parentCluster.PendingAcks[pendingAckKey(m.Header.From, m.Header.Sequence)]
+	p.parentCluster.ReliableMutex.Unlock()
+	if acked == nil {
+		//Late ack for a message that already succeeded or gave up
+		return nil
+	}
+	select {
+	case acked <- true:
+	default:
+	}
+	return nil
+}
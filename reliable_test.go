@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSequenceWindow(t *testing.T) {
+	window := NewSequenceWindow()
+	if !window.Observe(1) {
+		t.Error(errors.New("First sequence should be new"))
+	}
+	if window.Observe(1) {
+		t.Error(errors.New("Repeated sequence should be a duplicate"))
+	}
+	if !window.Observe(3) || !window.Observe(2) {
+		t.Error(errors.New("Out of order sequences should be new"))
+	}
+	window.Observe(sequenceWindowSize + 10)
+	if window.Observe(5) {
+		t.Error(errors.New("Sequence outside the window should be a duplicate"))
+	}
+}
+
+func TestSendReliable(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(2048)
+	RSA.GenerateKey()
+	network := NewMemoryNetwork()
+	C := Cluster{Transport: network.NewTransport(), RetransmitTimeout: time.Millisecond * 50, MaxRetransmits: 3}
+	C.Start("127.0.0.1", 8080, RSA.Key, 1)
+	C2 := Cluster{Transport: network.NewTransport()}
+	C2.Bootstrap("127.0.0.1", "127.0.0.1", 8082, 8080, RSA.Key, 1)
+	received := make(chan []byte, 2)
+	C2.RegisterHandler("greeting", func(From string, Payload []byte) {
+		received <- Payload
+	})
+	waitForPeer(&C, C2.LocalPeer.ID)
+	waitForPeer(&C2, C.LocalPeer.ID)
+	err := C.SendReliable(C2.LocalPeer.ID, "greeting", []byte("Hello"))
+	if err != nil {
+		t.Error(err)
+	}
+	select {
+	case payload := <-received:
+		if string(payload) != "Hello" {
+			t.Error(errors.New("Payload did not arrive intact"))
+		}
+	case <-time.After(time.Second * 2):
+		t.Error(errors.New("Message was not delivered"))
+	}
+
+	C2.Shutdown()
+	err = C.SendReliable(C2.LocalPeer.ID, "greeting", []byte("Hello"))
+	if err == nil {
+		t.Error(errors.New("Sending to a stopped peer should fail"))
+	}
+	C.Shutdown()
+}
+
+// rejoinNode restarts a simulated node under the same ID and identity key
+func rejoinNode(t *testing.T, S *Simulator, C *Cluster) *Cluster {
+	C.Shutdown()
+	rejoined := &Cluster{Transport: S.Faults.Wrap(S.Network.NewTransport()), Clock: S.Clock, NodeID: C.LocalPeer.ID, Synchronous: true, Suite: C.Suite, IdentityKey: C.IdentityKey}
+	err := rejoined.Bootstrap(S.Address(len(S.Clusters)), S.Address(0), 1, 1, S.Key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	S.Clusters = append(S.Clusters, rejoined)
+	return rejoined
+}
+
+func TestRejoinResetsSequences(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	C, _ := S.AddNode()
+	C2, _ := S.AddNode()
+	S.Run(time.Second * 2)
+	C.ObserveSequence(C2.LocalPeer.ID, 5)
+
+	//The restarted node numbers its messages from the start again
+	rejoined := rejoinNode(t, S, C2)
+	S.Run(time.Second * 2)
+	if !C.ObserveSequence(C2.LocalPeer.ID, 5) {
+		t.Error(errors.New("Rejoined peer's sequence numbers should start again"))
+	}
+
+	//Nothing is kept for a peer once it ages out
+	rejoined.Shutdown()
+	S.Run(C.PeerTimeout * 2)
+	C.ReliableMutex.Lock()
+	sequences := C.ReceivedSequences[C2.LocalPeer.ID]
+	C.ReliableMutex.Unlock()
+	if sequences != nil {
+		t.Error(errors.New("Departed peer's sequence numbers should be pruned"))
+	}
+	S.Shutdown()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+)
+
+// Security events counted when a message is rejected
+const (
+	SecurityReplayed = "replayed"
+	SecurityStale    = "stale"
+)
+
+// ReplayCache remembers the messages recently accepted from one sender
+type ReplayCache struct {
+	Seen map[uint64]int64
+	//Oldest timestamp first, whatever order the messages arrived in
+	Entries replayEntries
+	//Messages at or before Floor were evicted and can no longer be told apart
+	Floor int64
+}
+
+type ReplayEntry struct {
+	Nonce     uint64
+	Timestamp int64
+}
+
+type replayEntries []ReplayEntry
+
+func (e replayEntries) Len() int {
+	return len(e)
+}
+
+func (e replayEntries) Less(i, j int) bool {
+	return e[i].Timestamp < e[j].Timestamp
+}
+
+func (e replayEntries) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+func (e *replayEntries) Push(x interface{}) {
+	*e = append(*e, x.(ReplayEntry))
+}
+
+func (e *replayEntries) Pop() interface{} {
+	old := *e
+	entry := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return entry
+}
+
+// StampHeader records when a message was signed and a nonce to tell it apart
+func (c *Cluster) StampHeader(h *Header) {
+	h.Timestamp = c.Clock.Now().UnixNano()
+	c.RandomMutex.Lock()
+	h.Nonce = c.Random.Uint64()
+	c.RandomMutex.Unlock()
+}
+
+// CheckReplay accepts a signed header once within the replay window, and
+// returns the security event to count if it was rejected
+func (c *Cluster) CheckReplay(h Header) string {
+	now := c.Clock.Now().UnixNano()
+	window := int64(c.ReplayWindow)
+	//Clocks may be skewed either way by up to the window
+	if h.Timestamp < now-window || h.Timestamp > now+window {
+		return SecurityStale
+	}
+	c.ReplayMutex.Lock()
+	defer c.ReplayMutex.Unlock()
+	cache := c.ReplayCaches[h.From]
+	if cache == nil {
+		cache = &ReplayCache{Seen: make(map[uint64]int64), Floor: math.MinInt64}
+		c.ReplayCaches[h.From] = cache
+	}
+	cache.expire(now - window)
+	if h.Timestamp <= cache.Floor {
+		return SecurityStale
+	}
+	if _, ok := cache.Seen[h.Nonce]; ok {
+		return SecurityReplayed
+	}
+	cache.Seen[h.Nonce] = h.Timestamp
+	heap.Push(&cache.Entries, ReplayEntry{Nonce: h.Nonce, Timestamp: h.Timestamp})
+	if len(cache.Entries) > c.MaxSeenMessages {
+		cache.evict()
+	}
+	return ""
+}
+
+func (r *ReplayCache) expire(Before int64) {
+	for len(r.Entries) > 0 && r.Entries[0].Timestamp < Before {
+		r.evict()
+	}
+}
+
+// evict drops the oldest message, so Floor only rises as far as it
+func (r *ReplayCache) evict() {
+	entry := heap.Pop(&r.Entries).(ReplayEntry)
+	delete(r.Seen, entry.Nonce)
+	if entry.Timestamp > r.Floor {
+		r.Floor = entry.Timestamp
+	}
+}
+
+// ExpireReplays forgets senders with nothing left inside the replay window
+func (c *Cluster) ExpireReplays() {
+	before := c.Clock.Now().Add(-c.ReplayWindow).UnixNano()
+	c.ReplayMutex.Lock()
+	defer c.ReplayMutex.Unlock()
+	for sender, cache := range c.ReplayCaches {
+		cache.expire(before)
+		if len(cache.Entries) == 0 {
+			delete(c.ReplayCaches, sender)
+		}
+	}
+}
+
+func (c *Cluster) CountSecurityEvent(Reason string) {
+	c.ReplayMutex.Lock()
+	c.SecurityEvents[Reason]++
+	c.ReplayMutex.Unlock()
+}
+
+// SecurityEventCounts returns how many messages were rejected for each reason
+func (c *Cluster) SecurityEventCounts() map[string]uint64 {
+	c.ReplayMutex.Lock()
+	defer c.ReplayMutex.Unlock()
+	events := make(map[string]uint64)
+	for reason, count := range c.SecurityEvents {
+		events[reason] = count
+	}
+	return events
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckReplay(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	C := Cluster{Clock: clock, ReplayWindow: time.Minute, MaxSeenMessages: 2, ReplayCaches: make(map[string]*ReplayCache), ReplayMutex: new(sync.Mutex)}
+	now := clock.Now().UnixNano()
+	if C.CheckReplay(Header{From: "1", Timestamp: now, Nonce: 1}) != "" {
+		t.Error(errors.New("First message should be accepted"))
+	}
+	if C.CheckReplay(Header{From: "1", Timestamp: now, Nonce: 1}) != SecurityReplayed {
+		t.Error(errors.New("Repeated message should be a replay"))
+	}
+	if C.CheckReplay(Header{From: "2", Timestamp: now, Nonce: 1}) != "" {
+		t.Error(errors.New("Nonces are per sender"))
+	}
+	if C.CheckReplay(Header{From: "1", Timestamp: now - int64(time.Minute*2), Nonce: 2}) != SecurityStale {
+		t.Error(errors.New("Message outside the window should be stale"))
+	}
+	//Evicting the oldest message stops anything as old being accepted
+	C.CheckReplay(Header{From: "1", Timestamp: now + 1, Nonce: 3})
+	C.CheckReplay(Header{From: "1", Timestamp: now + 2, Nonce: 4})
+	if C.CheckReplay(Header{From: "1", Timestamp: now, Nonce: 1}) != SecurityStale {
+		t.Error(errors.New("Evicted message should not be accepted again"))
+	}
+	clock.Advance(time.Minute * 2)
+	C.ExpireReplays()
+	if len(C.ReplayCaches) != 0 {
+		t.Error(errors.New("Idle senders should be forgotten"))
+	}
+}
+
+func TestReplayReordered(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	C := Cluster{Clock: clock, ReplayWindow: time.Minute, MaxSeenMessages: 3, ReplayCaches: make(map[string]*ReplayCache), ReplayMutex: new(sync.Mutex)}
+	now := clock.Now().UnixNano()
+	//Arrives out of order and overflows the cache
+	for i, offset := range []int64{5, 1, 3, 2} {
+		if C.CheckReplay(Header{From: "1", Timestamp: now + offset, Nonce: uint64(i)}) != "" {
+			t.Error(errors.New("Reordered message should be accepted"))
+		}
+	}
+	//Only the oldest message was evicted
+	if C.CheckReplay(Header{From: "1", Timestamp: now + 4, Nonce: 10}) != "" {
+		t.Error(errors.New("Message newer than the evicted one should be accepted"))
+	}
+	if C.CheckReplay(Header{From: "1", Timestamp: now + 1, Nonce: 11}) != SecurityStale {
+		t.Error(errors.New("Message as old as the evicted one should be stale"))
+	}
+	if C.CheckReplay(Header{From: "1", Timestamp: now + 5, Nonce: 0}) != SecurityReplayed {
+		t.Error(errors.New("Newest message should still be remembered"))
+	}
+}
+
+func TestReplayedMessage(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	C, _ := S.AddNode()
+	C2, _ := S.AddNode()
+	S.Run(time.Second * 2)
+	received := 0
+	C2.RegisterHandler("greeting", func(From string, Payload []byte) {
+		received++
+	})
+	M := Message{Header: Header{ID: 4, From: C.LocalPeer.ID}, Body: Body{Content: DirectMessage{Type: "greeting"}}}
+	messageBytes, _ := C.LocalPeer.SealMessage(C.LocalPeer.Session(*C.Peers[C2.LocalPeer.ID]), M)
+	C2.LocalPeer.HandleMessage(messageBytes)
+	if C2.LocalPeer.HandleMessage(messageBytes) == nil {
+		t.Error(errors.New("Replayed message should be rejected"))
+	}
+	S.Run(time.Minute * 2)
+	if C2.LocalPeer.HandleMessage(messageBytes) == nil {
+		t.Error(errors.New("Old message should be rejected"))
+	}
+	if received != 1 {
+		t.Error(errors.New("Message should be handled once"))
+	}
+	events := C2.SecurityEventCounts()
+	if events[SecurityReplayed] != 1 || events[SecurityStale] != 1 {
+		t.Error(errors.New("Rejected messages were not counted"))
+	}
+	if C2.Score(C.LocalPeer.ID) != 0 {
+		t.Error(errors.New("Replays should not count against the sender"))
+	}
+	S.Shutdown()
+}
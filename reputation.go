@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Penalties added to the score of an address or peer that misbehaves
+const (
+	//Messages that fail decoding, decryption or verification
+	PenaltyInvalid = 10
+	//Messages that verify but break the protocol
+	PenaltyProtocol = 5
+	//Packets over the rate limit
+	PenaltyRateLimited = 1
+)
+
+// Reason a packet was dropped without being handled
+const DropBanned = "banned"
+
+// Ban keeps a source address or peer ID out of the cluster until it expires
+type Ban struct {
+	Target  string
+	Reason  string
+	Expires int64
+	//Peer that issued the ban, which gossip then carried
+	Issuer string
+	//Set when Target is a peer ID. Only these bans are gossiped, as source
+	//addresses can be spoofed to have an innocent address banned
+	Peer bool
+	//The issuer's identity signature over the ban
+	Signature []byte
+}
+
+// signedBan is what the issuer of a peer ban signs
+type signedBan struct {
+	Target  string
+	Reason  string
+	Expires int64
+	Issuer  string
+}
+
+func (b Ban) signedBytes() ([]byte, error) {
+	banBytes := bytes.Buffer{}
+	err := gob.NewEncoder(&banBytes).Encode(signedBan{Target: b.Target, Reason: b.Reason, Expires: b.Expires, Issuer: b.Issuer})
+	return banBytes.Bytes(), err
+}
+
+// Penalize adds to the scores of the address and the peer a message came
+// from, banning either once its score reaches the threshold. Addresses are
+// scored by host and port, so one misbehaving process does not get others on
+// the same host banned. The peer ID is only given once a message has
+// verified, as anyone can claim an ID
+func (c *Cluster) Penalize(Address, PeerID string, Points int, Reason string) {
+	if c.BanThreshold < 0 {
+		return
+	}
+	banned := make([]string, 0)
+	c.ReputationMutex.Lock()
+	for _, target := range []string{Address, PeerID} {
+		if target == "" {
+			continue
+		}
+		c.Scores[target] += Points
+		if c.Scores[target] >= c.BanThreshold {
+			delete(c.Scores, target)
+			banned = append(banned, target)
+		}
+	}
+	c.ReputationMutex.Unlock()
+	for _, target := range banned {
+		if target == PeerID {
+			//The peer's own verified messages are the evidence
+			c.BanPeer(target, Reason, c.BanDuration)
+		} else {
+			c.AddBan(target, Reason, c.BanDuration)
+		}
+	}
+}
+
+// penalizeInvalid holds a message that failed to decode or verify against
+// its source address. Anyone can forge the source of a packet, so an address
+// a peer has an established session on only has the message dropped
+func (c *Cluster) penalizeInvalid(Address string) {
+	if c.hasSessionAt(Address) {
+		return
+	}
+	c.Penalize(Address, "", PenaltyInvalid, "invalid")
+}
+
+// hasSessionAt reports whether a known peer at the address has a session
+func (c *Cluster) hasSessionAt(Address string) bool {
+	if Address == "" {
+		return false
+	}
+	c.PeersMutex.RLock()
+	ids := make([]string, 0)
+	for id, peer := range c.Peers {
+		if peer != nil && peer.Address() == Address {
+			ids = append(ids, id)
+		}
+	}
+	c.PeersMutex.RUnlock()
+	c.SessionsMutex.Lock()
+	defer c.SessionsMutex.Unlock()
+	for _, id := range ids {
+		if c.Sessions[id] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// AddBan bans an address or peer ID on this peer alone for the duration
+func (c *Cluster) AddBan(Target, Reason string, Duration time.Duration) {
+	c.addBan(Ban{Target: Target, Reason: Reason, Expires: c.Clock.Now().Add(Duration).UnixNano(), Issuer: c.LocalPeer.ID})
+}
+
+// BanPeer bans a peer ID for the duration, signing the ban so gossip can
+// carry it to peers that trust this one to issue bans
+func (c *Cluster) BanPeer(PeerID, Reason string, Duration time.Duration) error {
+	ban := Ban{Target: PeerID, Reason: Reason, Expires: c.Clock.Now().Add(Duration).UnixNano(), Issuer: c.LocalPeer.ID, Peer: true}
+	data, err := ban.signedBytes()
+	if err == nil {
+		ban.Signature, err = c.Suite.Sign(c.LocalPeer.identity, data)
+	}
+	if err != nil {
+		//Still banned here, just not across the cluster
+		ban.Peer = false
+	}
+	c.addBan(ban)
+	return err
+}
+
+func (c *Cluster) addBan(b Ban) {
+	c.ReputationMutex.Lock()
+	c.BanList[b.Target] = b
+	c.ReputationMutex.Unlock()
+	//A banned peer has to handshake again once the ban is lifted
+	c.DropSessions(b.Target)
+}
+
+func (c *Cluster) IsBanned(Target string) bool {
+	c.ReputationMutex.Lock()
+	defer c.ReputationMutex.Unlock()
+	ban, ok := c.BanList[Target]
+	return ok && ban.Expires > c.Clock.Now().UnixNano()
+}
+
+// Bans returns the bans in force, soonest to expire first
+func (c *Cluster) Bans() []Ban {
+	now := c.Clock.Now().UnixNano()
+	c.ReputationMutex.Lock()
+	bans := make([]Ban, 0, len(c.BanList))
+	for _, ban := range c.BanList {
+		if ban.Expires > now {
+			bans = append(bans, ban)
+		}
+	}
+	c.ReputationMutex.Unlock()
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Expires < bans[j].Expires
+	})
+	return bans
+}
+
+// Score returns the current misbehaviour score of an address or peer ID
+func (c *Cluster) Score(Target string) int {
+	c.ReputationMutex.Lock()
+	defer c.ReputationMutex.Unlock()
+	return c.Scores[Target]
+}
+
+// GossipBans returns the signed peer bans in force, which are the only bans
+// shared with other peers
+func (c *Cluster) GossipBans() []Ban {
+	bans := make([]Ban, 0)
+	for _, ban := range c.Bans() {
+		if ban.Peer {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+// MergeBans adopts peer bans gossiped by other peers. A ban must be signed by
+// the member that issued it and that member must be one of BanIssuers. A peer
+// never bans itself, and no gossiped ban lasts longer than a local one would
+func (c *Cluster) MergeBans(Bans []Ban) {
+	now := c.Clock.Now()
+	//Allows for the issuer's clock running ahead
+	longest := now.Add(c.BanDuration + c.ReplayWindow).UnixNano()
+	for _, ban := range Bans {
+		if !ban.Peer || ban.Target == c.LocalPeer.ID || ban.Expires <= now.UnixNano() || ban.Expires > longest {
+			continue
+		}
+		if !c.trustsBanIssuer(ban.Issuer) || c.verifyBan(ban) != nil {
+			continue
+		}
+		c.ReputationMutex.Lock()
+		existing, ok := c.BanList[ban.Target]
+		adopt := !ok || ban.Expires > existing.Expires
+		if adopt {
+			c.BanList[ban.Target] = ban
+		}
+		c.ReputationMutex.Unlock()
+		if adopt {
+			c.DropSessions(ban.Target)
+		}
+	}
+}
+
+// trustsBanIssuer reports whether BanIssuers lists the peer by ID or by one
+// of its roles, with "*" trusting every peer
+func (c *Cluster) trustsBanIssuer(Issuer string) bool {
+	if Issuer == c.LocalPeer.ID {
+		return false
+	}
+	roles := c.PeerRoles(Issuer)
+	for _, subject := range c.BanIssuers {
+		if subject == "*" || subject == Issuer {
+			return true
+		}
+		for _, role := range roles {
+			if subject == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Cluster) verifyBan(b Ban) error {
+	c.PeersMutex.RLock()
+	issuer := c.Peers[b.Issuer]
+	c.PeersMutex.RUnlock()
+	if issuer == nil || issuer.PublicKey == nil {
+		return errors.New("Unknown ban issuer")
+	}
+	data, err := b.signedBytes()
+	if err != nil {
+		return err
+	}
+	return c.Suite.Verify(issuer.PublicKey, data, b.Signature)
+}
+
+// ExpireBans lifts bans that have run out and halves every score, so only
+// sustained misbehaviour leads to a ban
+func (c *Cluster) ExpireBans() {
+	now := c.Clock.Now().UnixNano()
+	c.ReputationMutex.Lock()
+	defer c.ReputationMutex.Unlock()
+	for target, ban := range c.BanList {
+		if ban.Expires <= now {
+			delete(c.BanList, target)
+		}
+	}
+	for target := range c.Scores {
+		c.Scores[target] /= 2
+		if c.Scores[target] == 0 {
+			delete(c.Scores, target)
+		}
+	}
+}
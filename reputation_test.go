@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBanning(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 3; i++ {
+		S.AddCluster(&Cluster{BanDuration: time.Minute, BanIssuers: []string{"*"}})
+	}
+	S.Run(time.Second * 2)
+	C := S.Clusters[0]
+	attacker := S.Network.NewTransport()
+	attacker.Listen("10.9.9.9", 1, func(Address string, Packet []byte) {}, func(Address string, Message []byte) {})
+
+	//A few bad messages only raise the score
+	for i := 0; i < 3; i++ {
+		attacker.WriteStream(C.LocalPeer.Address(), []byte("garbage"))
+	}
+	S.Run(time.Millisecond)
+	if C.Score("10.9.9.9:1") != 3*PenaltyInvalid || C.IsBanned("10.9.9.9:1") {
+		t.Error(errors.New("Bad messages should raise the score without a ban"))
+	}
+	//Scores decay, so only sustained misbehaviour is banned
+	S.Run(time.Second * 5)
+	if C.Score("10.9.9.9:1") != 0 {
+		t.Error(errors.New("Score should decay"))
+	}
+	for i := 0; i < 15; i++ {
+		attacker.WriteStream(C.LocalPeer.Address(), []byte("garbage"))
+	}
+	S.Run(time.Millisecond)
+	bans := C.Bans()
+	if len(bans) != 1 || bans[0].Target != "10.9.9.9:1" || bans[0].Issuer != C.LocalPeer.ID {
+		t.Fatal(errors.New("Misbehaving address should be banned"))
+	}
+	if C.DropCounts()[DropBanned] == 0 {
+		t.Error(errors.New("Messages from a banned address should be dropped"))
+	}
+	//Garbage from an address a peer has a session on is only dropped
+	for i := 0; i < 15; i++ {
+		C.LocalPeer.ReceiveMessage(S.Clusters[1].LocalPeer.Address(), []byte("garbage"))
+	}
+	if C.Score(S.Clusters[1].LocalPeer.Address()) != 0 || C.IsBanned(S.Clusters[1].LocalPeer.Address()) {
+		t.Error(errors.New("Spoofed messages should not ban a peer's address"))
+	}
+	//Source addresses can be spoofed, so address bans stay local
+	S.Run(time.Second * 5)
+	for _, C := range S.Clusters[1:] {
+		if C.IsBanned("10.9.9.9:1") {
+			t.Error(errors.New("Address ban should not spread"))
+		}
+	}
+	//Signed peer bans spread to peers trusting the issuer
+	target := S.Clusters[2].LocalPeer.ID
+	C.BanPeer(target, "test", time.Minute)
+	S.Run(time.Second * 5)
+	if !S.Clusters[1].IsBanned(target) {
+		t.Error(errors.New("Peer ban did not spread"))
+	}
+	//A relay can not forge a ban in another peer's name
+	forged := Ban{Target: S.Clusters[1].LocalPeer.ID, Expires: S.Clock.Now().Add(time.Minute).UnixNano(), Issuer: C.LocalPeer.ID, Peer: true, Signature: []byte("forged")}
+	S.Clusters[2].MergeBans([]Ban{forged})
+	if S.Clusters[2].IsBanned(forged.Target) {
+		t.Error(errors.New("Forged ban should be refused"))
+	}
+	//Peers never take a ban against themselves from gossip
+	C.MergeBans([]Ban{{Target: C.LocalPeer.ID, Expires: S.Clock.Now().Add(time.Minute).UnixNano(), Peer: true}})
+	if C.IsBanned(C.LocalPeer.ID) {
+		t.Error(errors.New("Peer should not ban itself"))
+	}
+
+	S.Run(time.Minute)
+	for _, C := range S.Clusters {
+		if C.IsBanned("10.9.9.9:1") || len(C.Bans()) != 0 {
+			t.Error(errors.New("Ban should expire"))
+		}
+	}
+	S.Shutdown()
+}
+
+func TestMalformedBody(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 2; i++ {
+		S.AddNode()
+	}
+	S.Run(time.Second * 2)
+	C, C1 := S.Clusters[0], S.Clusters[1]
+	//A verified peer sending a body that does not match the message type is
+	//penalized rather than crashing the receiver
+	for _, ID := range []int{1, 4, 5, 6, 8, 9, 10, 11} {
+		M := Message{Header: Header{ID: ID, From: C1.LocalPeer.ID}, Body: Body{Content: Handshake{}}}
+		C1.LocalPeer.SendMessage(*C1.Peers[C.LocalPeer.ID], M)
+		S.Run(time.Millisecond)
+	}
+	if C.Score(C1.LocalPeer.ID) != 8*PenaltyProtocol {
+		t.Error(errors.New("Malformed messages should be penalized"))
+	}
+	S.Shutdown()
+}
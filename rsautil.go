@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"errors"
 	"io"
 )
 
@@ -50,3 +51,22 @@ func (r *RSAUtil) Decrypt(data []byte) ([]byte, error) {
 
 	return plaintext, nil
 }
+
+// SaveKey writes the key to a PEM file, encrypted if a passphrase is given
+func (r *RSAUtil) SaveKey(Path, Passphrase string) error {
+	return SavePrivateKey(Path, &r.Key, Passphrase)
+}
+
+// LoadKey reads the key from a PEM file written by SaveKey or openssl
+func (r *RSAUtil) LoadKey(Path, Passphrase string) error {
+	key, err := LoadPrivateKey(Path, Passphrase)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return errors.New("Key is not an RSA key")
+	}
+	r.Key = *rsaKey
+	return nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Handshake carries one side's ephemeral key for a new session
+type Handshake struct {
+	SessionID string
+	Ephemeral []byte
+}
+
+// Session holds the keys agreed with one peer. Messages are sealed with AES-GCM
+// under these keys, so long-term keys are only used to sign handshakes
+type Session struct {
+	ID          string
+	PeerID      string
+	SendKey     []byte
+	ReceiveKey  []byte
+	SendCounter uint64
+	Created     time.Time
+	//A responder only sends once the initiator has shown it has the keys
+	Confirmed bool
+	//Kept so a repeated handshake gets the same answer
+	LocalEphemeral  []byte
+	RemoteEphemeral []byte
+	Mutex           *sync.Mutex
+}
+
+// Sent returns how many messages have been sealed under the session
+func (s *Session) Sent() uint64 {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	return s.SendCounter
+}
+
+// PendingHandshake is a handshake waiting for its response, along with the
+// messages waiting for the session
+type PendingHandshake struct {
+	SessionID string
+	Private   *ecdh.PrivateKey
+	Queue     []QueuedMessage
+	Attempts  int
+}
+
+type QueuedMessage struct {
+	Message Message
+	Stream  bool
+}
+
+// Session returns the session to send to a peer with, starting a handshake
+// when there is none or the current one is due to be rekeyed
+func (p *Peer) Session(p2 Peer) *Session {
+	c := p.parentCluster
+	now := c.Clock.Now()
+	c.SessionsMutex.Lock()
+	session := c.Sessions[p2.ID]
+	if session != nil && now.Sub(session.Created) > c.RekeyInterval*2 {
+		//The peer will have forgotten it
+		session = nil
+	}
+	rekey := session == nil || now.Sub(session.Created) > c.RekeyInterval || session.Sent() > c.RekeyMessages
+	var pending *PendingHandshake
+	if rekey && c.PendingHandshakes[p2.ID] == nil {
+		pending = &PendingHandshake{}
+		c.PendingHandshakes[p2.ID] = pending
+	}
+	c.SessionsMutex.Unlock()
+	if pending != nil {
+		//The old session stays in use until the new one is agreed
+		err := p.StartHandshake(p2, pending)
+		if err != nil {
+			c.SessionsMutex.Lock()
+			delete(c.PendingHandshakes, p2.ID)
+			c.SessionsMutex.Unlock()
+		}
+	}
+	return session
+}
+
+func (p *Peer) StartHandshake(p2 Peer, pending *PendingHandshake) error {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+	p.parentCluster.SessionsMutex.Lock()
+	pending.SessionID = id.String()
+	pending.Private = private
+	p.parentCluster.SessionsMutex.Unlock()
+	p.retryHandshake(p2, pending, p.parentCluster.RetransmitTimeout)
+	return nil
+}
+
+func (p *Peer) retryHandshake(p2 Peer, pending *PendingHandshake, timeout time.Duration) {
+	c := p.parentCluster
+	c.SessionsMutex.Lock()
+	if c.PendingHandshakes[p2.ID] != pending || p.Stopped() {
+		//Completed or replaced
+		c.SessionsMutex.Unlock()
+		return
+	}
+	if pending.Attempts > c.MaxRetransmits {
+		//Give up, dropping the messages that were waiting
+		delete(c.PendingHandshakes, p2.ID)
+		c.SessionsMutex.Unlock()
+		return
+	}
+	pending.Attempts++
+	c.SessionsMutex.Unlock()
+	M := Message{Header: Header{ID: 12, From: p.ID}, Body: Body{Content: Handshake{SessionID: pending.SessionID, Ephemeral: pending.Private.PublicKey().Bytes()}}}
+	p.sendHandshake(p2, M)
+	c.Clock.AfterFunc(timeout, func() {
+		p.retryHandshake(p2, pending, timeout*2)
+	})
+}
+
+func (p *Peer) sendHandshake(p2 Peer, m Message) error {
+	messageBytes, err := p.EncodeMessage(p2, m)
+	if err != nil {
+		return err
+	}
+	return p.WritePacket(p2, messageBytes)
+}
+
+// HandleHandshake answers a peer starting a session with its own ephemeral key
+func (p *Peer) HandleHandshake(m Message) error {
+	handshake, ok := m.Body.Content.(Handshake)
+	if !ok {
+		return p.malformed(m)
+	}
+	c := p.parentCluster
+	c.PeersMutex.RLock()
+	initiator := c.Peers[m.Header.From]
+	c.PeersMutex.RUnlock()
+	if initiator == nil {
+		return errors.New("Unknown peer")
+	}
+	c.SessionsMutex.Lock()
+	session := c.SessionsByID[handshake.SessionID]
+	c.SessionsMutex.Unlock()
+	if session != nil {
+		//A retried handshake whose response was lost
+		if session.PeerID != m.Header.From || !bytes.Equal(session.RemoteEphemeral, handshake.Ephemeral) {
+			return errors.New("Session ID already in use")
+		}
+	} else {
+		private, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		session, err = c.NewSession(handshake.SessionID, m.Header.From, private, handshake.Ephemeral, false)
+		if err != nil {
+			return err
+		}
+		//Not used for sending until the initiator's first message arrives
+		c.SessionsMutex.Lock()
+		c.SessionsByID[session.ID] = session
+		c.SessionsMutex.Unlock()
+	}
+	M := Message{Header: Header{ID: 13, From: p.ID}, Body: Body{Content: Handshake{SessionID: session.ID, Ephemeral: session.LocalEphemeral}}}
+	return p.sendHandshake(*initiator, M)
+}
+
+// HandleHandshakeResponse completes a handshake this peer started
+func (p *Peer) HandleHandshakeResponse(m Message) error {
+	handshake, ok := m.Body.Content.(Handshake)
+	if !ok {
+		return p.malformed(m)
+	}
+	c := p.parentCluster
+	c.PeersMutex.RLock()
+	responder := c.Peers[m.Header.From]
+	c.PeersMutex.RUnlock()
+	if responder == nil {
+		return errors.New("Unknown peer")
+	}
+	c.SessionsMutex.Lock()
+	pending := c.PendingHandshakes[m.Header.From]
+	if pending == nil || pending.SessionID != handshake.SessionID {
+		c.SessionsMutex.Unlock()
+		//Duplicate or late response
+		return nil
+	}
+	c.SessionsMutex.Unlock()
+	session, err := c.NewSession(handshake.SessionID, m.Header.From, pending.Private, handshake.Ephemeral, true)
+	if err != nil {
+		return err
+	}
+	session.Confirmed = true
+	c.AddSession(session)
+	return p.flushQueue(*responder)
+}
+
+func (p *Peer) flushQueue(p2 Peer) error {
+	c := p.parentCluster
+	c.SessionsMutex.Lock()
+	pending := c.PendingHandshakes[p2.ID]
+	if pending == nil {
+		c.SessionsMutex.Unlock()
+		return nil
+	}
+	queue := pending.Queue
+	pending.Queue = nil
+	if c.Sessions[p2.ID] != nil && c.Sessions[p2.ID].ID == pending.SessionID {
+		delete(c.PendingHandshakes, p2.ID)
+	}
+	c.SessionsMutex.Unlock()
+	for _, queued := range queue {
+		if queued.Stream {
+			p.SendStreamMessage(p2, queued.Message)
+		} else {
+			p.SendMessage(p2, queued.Message)
+		}
+	}
+	return nil
+}
+
+// confirmSession starts sending with a responder session once the initiator
+// has used it, along with any messages waiting for a session
+func (p *Peer) confirmSession(s *Session) {
+	c := p.parentCluster
+	c.SessionsMutex.Lock()
+	if s.Confirmed {
+		c.SessionsMutex.Unlock()
+		return
+	}
+	s.Confirmed = true
+	current := c.Sessions[s.PeerID]
+	if current == nil || current.Created.Before(s.Created) {
+		c.Sessions[s.PeerID] = s
+	}
+	c.SessionsMutex.Unlock()
+	c.PeersMutex.RLock()
+	peer := c.Peers[s.PeerID]
+	c.PeersMutex.RUnlock()
+	if peer != nil {
+		p.flushQueue(*peer)
+	}
+}
+
+// QueueMessage holds a message until the handshake with its peer completes
+func (c *Cluster) QueueMessage(p2 Peer, m Message, Stream bool) error {
+	c.SessionsMutex.Lock()
+	defer c.SessionsMutex.Unlock()
+	pending := c.PendingHandshakes[p2.ID]
+	if pending == nil {
+		return errors.New("No session with peer")
+	}
+	if len(pending.Queue) >= c.MaxQueuedMessages {
+		return errors.New("Too many messages waiting for a session")
+	}
+	pending.Queue = append(pending.Queue, QueuedMessage{Message: m, Stream: Stream})
+	return nil
+}
+
+// NewSession derives the session keys from an X25519 exchange. Each direction
+// gets its own key, bound to the session ID and both peers
+func (c *Cluster) NewSession(ID, PeerID string, Private *ecdh.PrivateKey, Remote []byte, Initiator bool) (*Session, error) {
+	remote, err := ecdh.X25519().NewPublicKey(Remote)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := Private.ECDH(remote)
+	if err != nil {
+		return nil, err
+	}
+	initiatorID, responderID := c.LocalPeer.ID, PeerID
+	if !Initiator {
+		initiatorID, responderID = PeerID, c.LocalPeer.ID
+	}
+	initiatorKey := deriveKey(secret, []byte(ID), "initiator "+initiatorID+" "+responderID)
+	responderKey := deriveKey(secret, []byte(ID), "responder "+initiatorID+" "+responderID)
+	session := &Session{ID: ID, PeerID: PeerID, Created: c.Clock.Now(), LocalEphemeral: Private.PublicKey().Bytes(), RemoteEphemeral: Remote, Mutex: new(sync.Mutex)}
+	if Initiator {
+		session.SendKey, session.ReceiveKey = initiatorKey, responderKey
+	} else {
+		session.SendKey, session.ReceiveKey = responderKey, initiatorKey
+	}
+	return session, nil
+}
+
+// deriveKey is HKDF-SHA256 producing a single 32 byte key
+func deriveKey(Secret, Salt []byte, Info string) []byte {
+	extract := hmac.New(sha256.New, Salt)
+	extract.Write(Secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(Info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func (c *Cluster) AddSession(s *Session) {
+	c.SessionsMutex.Lock()
+	c.Sessions[s.PeerID] = s
+	c.SessionsByID[s.ID] = s
+	c.SessionsMutex.Unlock()
+}
+
+// DropSessions forgets every session with a peer that left or rejoined
+func (c *Cluster) DropSessions(PeerID string) {
+	c.SessionsMutex.Lock()
+	defer c.SessionsMutex.Unlock()
+	delete(c.Sessions, PeerID)
+	delete(c.PendingHandshakes, PeerID)
+	for id, session := range c.SessionsByID {
+		if session.PeerID == PeerID {
+			delete(c.SessionsByID, id)
+		}
+	}
+}
+
+// ExpireSessions forgets sessions old enough that peers have rekeyed
+func (c *Cluster) ExpireSessions() {
+	now := c.Clock.Now()
+	c.SessionsMutex.Lock()
+	defer c.SessionsMutex.Unlock()
+	for id, session := range c.SessionsByID {
+		if now.Sub(session.Created) > c.RekeyInterval*2 {
+			delete(c.SessionsByID, id)
+			if c.Sessions[session.PeerID] == session {
+				delete(c.Sessions, session.PeerID)
+			}
+		}
+	}
+}
+
+// SealMessage encrypts a message under a session
+func (p *Peer) SealMessage(s *Session, m Message) ([]byte, error) {
+	p.parentCluster.StampHeader(&m.Header)
+	messageBytes, err := m.Encode()
+	if err != nil {
+		return nil, err
+	}
+	//Nonces count up so they never repeat under one key
+	s.Mutex.Lock()
+	s.SendCounter++
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], s.SendCounter)
+	s.Mutex.Unlock()
+	ciphertext, err := Encrypt(messageBytes, s.SendKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	encryptedMessage := EncryptedMessage{Message: ciphertext, Nonce: nonce, Session: s.ID}
+	return encryptedMessage.Encode()
+}
+
+// OpenSessionMessage decrypts a message sealed under a session. The session
+// key authenticates the sender, so there is no signature to check
+func (p *Peer) OpenSessionMessage(m EncryptedMessage) (*Message, error) {
+	p.parentCluster.SessionsMutex.Lock()
+	session := p.parentCluster.SessionsByID[m.Session]
+	p.parentCluster.SessionsMutex.Unlock()
+	if session == nil {
+		return nil, errors.New("Unknown session")
+	}
+	plaintext, err := Decrypt(m.Message, session.ReceiveKey, m.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	decryptedMessage := Message{}
+	err = gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&decryptedMessage)
+	if err != nil {
+		return nil, err
+	}
+	if decryptedMessage.Header.From != session.PeerID {
+		return nil, errors.New("Message sender does not match session")
+	}
+	p.confirmSession(session)
+	return &decryptedMessage, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	C := &Cluster{RekeyInterval: time.Second * 10}
+	S.AddCluster(C)
+	C2, _ := S.AddNode()
+	received := 0
+	C2.RegisterHandler("greeting", func(From string, Payload []byte) {
+		received++
+	})
+	S.Run(time.Second * 2)
+
+	session := C.Sessions[C2.LocalPeer.ID]
+	if session == nil {
+		t.Fatal(errors.New("Session was not established"))
+	}
+	remote := C2.SessionsByID[session.ID]
+	if remote == nil || !bytes.Equal(session.SendKey, remote.ReceiveKey) || !bytes.Equal(session.ReceiveKey, remote.SendKey) {
+		t.Error(errors.New("Peers did not agree on session keys"))
+	}
+	if bytes.Equal(session.SendKey, session.ReceiveKey) {
+		t.Error(errors.New("Each direction should have its own key"))
+	}
+	C.Send(C2.LocalPeer.ID, "greeting", []byte("Hello"))
+	S.Run(time.Second)
+	if received != 1 {
+		t.Error(errors.New("Message was not delivered over the session"))
+	}
+
+	//Sessions are replaced once they are due for rekeying
+	S.Run(time.Second * 15)
+	rekeyed := C.Sessions[C2.LocalPeer.ID]
+	if rekeyed == nil || rekeyed.ID == session.ID {
+		t.Error(errors.New("Session was not rekeyed"))
+	}
+	C.Send(C2.LocalPeer.ID, "greeting", []byte("Hello"))
+	S.Run(time.Second)
+	if received != 2 {
+		t.Error(errors.New("Message was not delivered after rekeying"))
+	}
+
+	//A session only carries messages from the peer it was agreed with
+	M := Message{Header: Header{ID: 4, From: "someone-else"}, Body: Body{Content: DirectMessage{Type: "greeting"}}}
+	messageBytes, _ := C.LocalPeer.SealMessage(rekeyed, M)
+	if C2.LocalPeer.HandleMessage(messageBytes) == nil {
+		t.Error(errors.New("Message from another sender should be rejected"))
+	}
+	S.Shutdown()
+}
+
+func TestSessionHandshakeLoss(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	C, _ := S.AddNode()
+	C2, _ := S.AddNode()
+	S.Run(time.Second * 2)
+	C.DropSessions(C2.LocalPeer.ID)
+	C2.DropSessions(C.LocalPeer.ID)
+
+	received := 0
+	C2.RegisterHandler("greeting", func(From string, Payload []byte) {
+		received++
+	})
+	//Messages wait for the handshake, which is retried when lost
+	S.Faults.Partition("split", []string{C.LocalPeer.Address()}, []string{C2.LocalPeer.Address()})
+	C.Send(C2.LocalPeer.ID, "greeting", []byte("Hello"))
+	S.Run(time.Millisecond * 300)
+	if received != 0 {
+		t.Error(errors.New("Message should wait for the handshake"))
+	}
+	S.Faults.Heal("split")
+	S.Run(time.Second * 10)
+	if received != 1 {
+		t.Error(errors.New("Queued message was not delivered after the handshake"))
+	}
+	S.Shutdown()
+}
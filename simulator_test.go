@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func simulatedPeerIDs(RSA RSAUtil, Faults FaultConfig) ([][]string, error) {
+	S := NewSimulator(1, RSA.Key, Faults)
+	for i := 0; i < 4; i++ {
+		_, err := S.AddNode()
+		if err != nil {
+			return nil, err
+		}
+		S.Run(time.Second)
+	}
+	S.Run(time.Second * 20)
+	peerIDs := make([][]string, 0)
+	for _, C := range S.Clusters {
+		peerIDs = append(peerIDs, append([]string(nil), C.PeerIDs...))
+	}
+	S.Shutdown()
+	return peerIDs, nil
+}
+
+func TestSimulatorReplays(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	faults := FaultConfig{Loss: 0.1, Reorder: 0.1, Latency: time.Millisecond * 20, Jitter: time.Millisecond * 20}
+	first, err := simulatedPeerIDs(RSA, faults)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, peerIDs := range first {
+		if len(peerIDs) != 4 {
+			t.Error(errors.New("Peers did not propagate"))
+		}
+	}
+	second, _ := simulatedPeerIDs(RSA, faults)
+	if !reflect.DeepEqual(first, second) {
+		t.Error(errors.New("Simulation did not replay the same way"))
+	}
+}
+
+func TestSimulatorAgesOutPeers(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 3; i++ {
+		S.AddNode()
+	}
+	S.Run(time.Second * 5)
+	failed := S.Clusters[2]
+	failed.Shutdown()
+	S.Run(time.Second * 70)
+	for _, C := range S.Clusters[:2] {
+		if C.Peers[failed.LocalPeer.ID] != nil {
+			t.Error(errors.New("Failed peer was not aged out"))
+		}
+	}
+	S.Shutdown()
+}
+
+func TestSimulatorRetriesBootstrap(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	seed, _ := S.AddNode()
+	//The first attempts to reach the seed are lost
+	S.Faults.Partition("split", []string{S.Address(0) + ":1"}, []string{S.Address(1) + ":1"})
+	joiner, err := S.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	S.Run(time.Second * 2)
+	if joiner.Peers[seed.LocalPeer.ID] != nil {
+		t.Error(errors.New("Bootstrap should not get through the partition"))
+	}
+	S.Faults.Heal("split")
+	S.Run(time.Second * 10)
+	if joiner.Peers[seed.LocalPeer.ID] == nil || seed.Peers[joiner.LocalPeer.ID] == nil {
+		t.Error(errors.New("Bootstrap was not retried"))
+	}
+	S.Shutdown()
+}
+
+func TestSimulatorPeerDigest(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 4; i++ {
+		S.AddNode()
+	}
+	S.Run(time.Second * 10)
+	//Peers learn each other in different orders but agree on the digest
+	C := S.Clusters[0]
+	for _, other := range S.Clusters[1:] {
+		if other.PeerDigest() != C.PeerDigest() {
+			t.Error(errors.New("Converged peers should share a digest"))
+		}
+	}
+	//A peer missing from one node's list comes back through gossip, as
+	//the digests no longer match
+	missing := S.Clusters[3].LocalPeer.ID
+	C.PeersMutex.Lock()
+	C.removePeer(missing)
+	C.PeersMutex.Unlock()
+	if C.PeerDigest() == S.Clusters[1].PeerDigest() {
+		t.Error(errors.New("Digest should change with the peers"))
+	}
+	S.Run(time.Second * 10)
+	if C.Peers[missing] == nil || C.PeerDigest() != S.Clusters[1].PeerDigest() {
+		t.Error(errors.New("Differing digests should exchange peer lists"))
+	}
+	S.Shutdown()
+}
+
+func simulateNodes(RSA RSAUtil, Nodes int, Duration time.Duration) *Simulator {
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < Nodes; i++ {
+		S.AddNode()
+	}
+	S.Run(Duration)
+	return S
+}
+
+func TestSimulatorScale(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping large simulation in short mode")
+	}
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := simulateNodes(RSA, 100, time.Second*30)
+	for _, C := range S.Clusters {
+		if len(C.PeerIDs) != 100 {
+			t.Error(errors.New("Peers did not converge"))
+			break
+		}
+	}
+	S.Shutdown()
+}
+
+func BenchmarkSimulator(b *testing.B) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		simulateNodes(RSA, 50, time.Second*30).Shutdown()
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+)
+
+// Suite is the family of identity keys a cluster signs handshakes with.
+// Sessions always agree keys with X25519 whichever suite signs for them
+type Suite interface {
+	Name() string
+	GenerateKey() (crypto.Signer, error)
+	Sign(Key crypto.Signer, Data []byte) ([]byte, error)
+	Verify(PublicKey, Data, Signature []byte) error
+}
+
+// RSASuite signs with RSA PKCS1v15 over SHA-256
+type RSASuite struct {
+	Length int
+}
+
+func (s RSASuite) Name() string {
+	return "rsa"
+}
+
+func (s RSASuite) GenerateKey() (crypto.Signer, error) {
+	return rsa.GenerateKey(rand.Reader, s.Length)
+}
+
+func (s RSASuite) Sign(Key crypto.Signer, Data []byte) ([]byte, error) {
+	hash := sha256.Sum256(Data)
+	return Key.Sign(rand.Reader, hash[:], crypto.SHA256)
+}
+
+func (s RSASuite) Verify(PublicKey, Data, Signature []byte) error {
+	key, err := x509.ParsePKIXPublicKey(PublicKey)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("Public key is not an RSA key")
+	}
+	hash := sha256.Sum256(Data)
+	return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hash[:], Signature)
+}
+
+// Ed25519Suite signs with Ed25519, with far smaller keys and signatures than RSA
+type Ed25519Suite struct{}
+
+func (s Ed25519Suite) Name() string {
+	return "ed25519"
+}
+
+func (s Ed25519Suite) GenerateKey() (crypto.Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+func (s Ed25519Suite) Sign(Key crypto.Signer, Data []byte) ([]byte, error) {
+	return Key.Sign(rand.Reader, Data, crypto.Hash(0))
+}
+
+func (s Ed25519Suite) Verify(PublicKey, Data, Signature []byte) error {
+	key, err := x509.ParsePKIXPublicKey(PublicKey)
+	if err != nil {
+		return err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return errors.New("Public key is not an Ed25519 key")
+	}
+	if !ed25519.Verify(edKey, Data, Signature) {
+		return errors.New("Invalid signature")
+	}
+	return nil
+}
+
+// MarshalPublicKey encodes a signer's public key to share with other peers
+func MarshalPublicKey(Key crypto.Signer) ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(Key.Public())
+}
+
+// SignWith signs the header and body with an identity key
+func (m *Message) SignWith(Suite Suite, Key crypto.Signer) error {
+	headerBytes, err := m.Header.Encode()
+	if err != nil {
+		return err
+	}
+	bodyBytes, err := m.Body.Encode()
+	if err != nil {
+		return err
+	}
+	m.HeaderSignature, err = Suite.Sign(Key, headerBytes)
+	if err != nil {
+		return err
+	}
+	m.BodySignature, err = Suite.Sign(Key, bodyBytes)
+	return err
+}
+
+// VerifyWith checks the header and body were signed by the holder of PublicKey
+func (m *Message) VerifyWith(Suite Suite, PublicKey []byte) error {
+	headerBytes, err := m.Header.Encode()
+	if err != nil {
+		return err
+	}
+	bodyBytes, err := m.Body.Encode()
+	if err != nil {
+		return err
+	}
+	if Suite.Verify(PublicKey, headerBytes, m.HeaderSignature) != nil {
+		return errors.New("Invalid Header Signature")
+	}
+	if Suite.Verify(PublicKey, bodyBytes, m.BodySignature) != nil {
+		return errors.New("Invalid Body Signature")
+	}
+	return nil
+}
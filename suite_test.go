@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSuites(t *testing.T) {
+	for _, suite := range []Suite{RSASuite{Length: 1024}, Ed25519Suite{}} {
+		key, err := suite.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKey, err := MarshalPublicKey(key)
+		if err != nil {
+			t.Error(err)
+		}
+		m := Message{Header: Header{ID: 12, From: "1"}, Body: Body{Content: "Hello"}}
+		err = m.SignWith(suite, key)
+		if err != nil {
+			t.Error(err)
+		}
+		err = m.VerifyWith(suite, publicKey)
+		if err != nil {
+			t.Error(err)
+		}
+		m.Header.From = "2"
+		if m.VerifyWith(suite, publicKey) == nil {
+			t.Error(errors.New("Modified header should not verify"))
+		}
+	}
+	key, _ := Ed25519Suite{}.GenerateKey()
+	publicKey, _ := MarshalPublicKey(key)
+	if (RSASuite{}).Verify(publicKey, []byte("data"), []byte("signature")) == nil {
+		t.Error(errors.New("RSA suite should not accept an Ed25519 key"))
+	}
+}
+
+func TestEd25519Cluster(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 3; i++ {
+		S.AddCluster(&Cluster{Suite: Ed25519Suite{}})
+	}
+	//Peers on another suite are turned away when they join
+	S.AddCluster(&Cluster{Suite: RSASuite{Length: 1024}})
+	received := 0
+	S.Clusters[2].RegisterHandler("greeting", func(From string, Payload []byte) {
+		received++
+	})
+	S.Run(time.Second * 5)
+	for _, C := range S.Clusters[:3] {
+		if len(C.PeerList()) != 3 {
+			t.Error(errors.New("Only peers on the same suite should join"))
+		}
+	}
+	S.Clusters[1].Send(S.Clusters[2].LocalPeer.ID, "greeting", []byte("Hello"))
+	S.Run(time.Second)
+	if received != 1 {
+		t.Error(errors.New("Message was not delivered between Ed25519 peers"))
+	}
+	S.Shutdown()
+}
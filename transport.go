@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+type PacketHandler func(Address string, Packet []byte)
+
+type StreamHandler func(Address string, Message []byte)
+
+// Transport moves packets and stream messages between peers addressed by IP:Port
+type Transport interface {
+	Listen(IP string, Port int, Packets PacketHandler, Streams StreamHandler) error
+	WritePacket(Address string, Packet []byte) error
+	WriteStream(Address string, Message []byte) error
+	Close() error
+}
+
+type StreamConnection struct {
+	Conn  net.Conn
+	Mutex *sync.Mutex
+}
+
+// NetTransport sends packets over UDP and streams over TCP on the following port.
+// Each host may hold at most MaxStreamsPerHost inbound streams open at once
+type NetTransport struct {
+	MaxStreamMessageSize int
+	MaxStreamsPerHost    int
+	server               *net.UDPConn
+	streamServer         *net.TCPListener
+	streams              map[string]*StreamConnection
+	inbound              map[string]int
+	streamsMutex         *sync.Mutex
+}
+
+func NewNetTransport() *NetTransport {
+	return &NetTransport{MaxStreamMessageSize: 4 << 20, MaxStreamsPerHost: 4, streams: make(map[string]*StreamConnection), inbound: make(map[string]int), streamsMutex: new(sync.Mutex)}
+}
+
+func (t *NetTransport) Listen(IP string, Port int, Packets PacketHandler, Streams StreamHandler) error {
+	//Create UDPConn
+	u, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(IP), Port: Port})
+	if err != nil {
+		return err
+	}
+	//Streams listen on the port after the datagram port
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(IP), Port: Port + 1})
+	if err != nil {
+		u.Close()
+		return err
+	}
+	t.server = u
+	t.streamServer = l
+
+	//Listen to incoming packets
+	go func() {
+		for {
+			buf := make([]byte, 65507)
+			//Read data from connection
+			n, addr, err := t.server.ReadFrom(buf)
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			if err != nil {
+				continue
+			}
+			Packets(addr.String(), buf[:n])
+		}
+	}()
+
+	//Listen to incoming streams
+	go func() {
+		for {
+			conn, err := t.streamServer.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			if err != nil {
+				continue
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if !t.acceptStream(host) {
+				conn.Close()
+				continue
+			}
+			go t.readStream(host, conn, Streams)
+		}
+	}()
+	return nil
+}
+
+// acceptStream counts an inbound stream against its host, refusing it when the
+// host already holds the maximum
+func (t *NetTransport) acceptStream(Host string) bool {
+	t.streamsMutex.Lock()
+	defer t.streamsMutex.Unlock()
+	if t.inbound[Host] >= t.MaxStreamsPerHost {
+		return false
+	}
+	t.inbound[Host]++
+	return true
+}
+
+func (t *NetTransport) readStream(Host string, conn net.Conn, Streams StreamHandler) error {
+	defer func() {
+		conn.Close()
+		t.streamsMutex.Lock()
+		t.inbound[Host]--
+		if t.inbound[Host] <= 0 {
+			delete(t.inbound, Host)
+		}
+		t.streamsMutex.Unlock()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := ReadFrame(reader, t.MaxStreamMessageSize)
+		if err != nil {
+			return err
+		}
+		Streams(conn.RemoteAddr().String(), message)
+	}
+}
+
+func (t *NetTransport) WritePacket(Address string, Packet []byte) error {
+	addr, err := net.ResolveUDPAddr("udp", Address)
+	if err != nil {
+		return err
+	}
+	//Write from the listening socket so every packet shares one source address
+	_, err = t.server.WriteTo(Packet, addr)
+	return err
+}
+
+func (t *NetTransport) WriteStream(Address string, Message []byte) error {
+	host, port, err := net.SplitHostPort(Address)
+	if err != nil {
+		return err
+	}
+	streamPort, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	streamAddress := net.JoinHostPort(host, strconv.Itoa(streamPort+1))
+	//Reuse an open connection, redialing once if it has gone away
+	for attempt := 0; attempt < 2; attempt++ {
+		stream, err := t.streamConnection(streamAddress)
+		if err != nil {
+			return err
+		}
+		stream.Mutex.Lock()
+		err = WriteFrame(stream.Conn, Message, t.MaxStreamMessageSize)
+		stream.Mutex.Unlock()
+		if err == nil {
+			return nil
+		}
+		t.closeStreamConnection(streamAddress, stream)
+	}
+	return errors.New("Failed to write to stream")
+}
+
+func (t *NetTransport) streamConnection(Address string) (*StreamConnection, error) {
+	t.streamsMutex.Lock()
+	defer t.streamsMutex.Unlock()
+	stream := t.streams[Address]
+	if stream != nil {
+		return stream, nil
+	}
+	conn, err := net.Dial("tcp", Address)
+	if err != nil {
+		return nil, err
+	}
+	stream = &StreamConnection{Conn: conn, Mutex: new(sync.Mutex)}
+	t.streams[Address] = stream
+	return stream, nil
+}
+
+func (t *NetTransport) closeStreamConnection(Address string, stream *StreamConnection) error {
+	t.streamsMutex.Lock()
+	if t.streams[Address] == stream {
+		delete(t.streams, Address)
+	}
+	t.streamsMutex.Unlock()
+	return stream.Conn.Close()
+}
+
+func (t *NetTransport) Close() error {
+	//Closing the listeners ends the listen loops. Close TCPListener and any open streams
+	t.streamServer.Close()
+	t.streamsMutex.Lock()
+	for address, stream := range t.streams {
+		stream.Conn.Close()
+		delete(t.streams, address)
+	}
+	t.streamsMutex.Unlock()
+	//Close UDPConn
+	return t.server.Close()
+}
+
+// ReadFrame reads one length prefixed message from a stream. The buffer grows
+// with the data that actually arrives rather than the length the frame claims
+func ReadFrame(reader io.Reader, MaxSize int) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if int64(length) > int64(MaxSize) {
+		return nil, errors.New("Stream message exceeds maximum size")
+	}
+	message := bytes.Buffer{}
+	n, err := io.Copy(&message, io.LimitReader(reader, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if n < int64(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return message.Bytes(), nil
+}
+
+// WriteFrame writes one length prefixed message to a stream
+func WriteFrame(writer io.Writer, message []byte, MaxSize int) error {
+	if len(message) > MaxSize {
+		return errors.New("Stream message exceeds maximum size")
+	}
+	frame := make([]byte, 4, 4+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	_, err := writer.Write(append(frame, message...))
+	return err
+}
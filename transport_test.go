@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrame(t *testing.T) {
+	stream := bytes.Buffer{}
+	err := WriteFrame(&stream, []byte("Hello"), 1024)
+	if err != nil {
+		t.Error(err)
+	}
+	WriteFrame(&stream, []byte("World"), 1024)
+	first, err := ReadFrame(&stream, 1024)
+	if err != nil {
+		t.Error(err)
+	}
+	second, _ := ReadFrame(&stream, 1024)
+	if string(first) != "Hello" || string(second) != "World" {
+		t.Error(errors.New("Frames did not round trip"))
+	}
+	err = WriteFrame(&stream, make([]byte, 2048), 1024)
+	if err == nil {
+		t.Error(errors.New("Oversized frame should be rejected"))
+	}
+	//A frame claiming more than it carries fails once the data runs out
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, 1<<20)
+	stream.Reset()
+	stream.Write(append(header, []byte("short")...))
+	_, err = ReadFrame(&stream, 1<<20)
+	if err != io.ErrUnexpectedEOF {
+		t.Error(errors.New("Truncated frame should be rejected"))
+	}
+}
+
+func TestNetTransport(t *testing.T) {
+	packets := make(chan []byte, 1)
+	streams := make(chan []byte, 2)
+	T := NewNetTransport()
+	err := T.Listen("127.0.0.1", 8080, func(Address string, Packet []byte) {
+		packets <- Packet
+	}, func(Address string, Message []byte) {
+		streams <- Message
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	T2 := NewNetTransport()
+	err = T2.Listen("127.0.0.1", 8082, func(Address string, Packet []byte) {}, func(Address string, Message []byte) {})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = T2.WritePacket("127.0.0.1:8080", []byte("Hello"))
+	if err != nil {
+		t.Error(err)
+	}
+	select {
+	case packet := <-packets:
+		if string(packet) != "Hello" {
+			t.Error(errors.New("Packet did not arrive intact"))
+		}
+	case <-time.After(time.Second * 2):
+		t.Error(errors.New("Packet was not delivered"))
+	}
+
+	for i := 0; i < 2; i++ {
+		err = T2.WriteStream("127.0.0.1:8080", []byte("World"))
+		if err != nil {
+			t.Error(err)
+		}
+		select {
+		case message := <-streams:
+			if string(message) != "World" {
+				t.Error(errors.New("Stream message did not arrive intact"))
+			}
+		case <-time.After(time.Second * 2):
+			t.Error(errors.New("Stream message was not delivered"))
+		}
+	}
+	//Both writes share one connection
+	if len(T2.streams) != 1 {
+		t.Error(errors.New("Stream connection was not reused"))
+	}
+	T.Close()
+	T2.Close()
+}
+
+func TestStreamsPerHost(t *testing.T) {
+	T := NewNetTransport()
+	T.MaxStreamsPerHost = 1
+	err := T.Listen("127.0.0.1", 8096, func(Address string, Packet []byte) {}, func(Address string, Message []byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := net.Dial("tcp", "127.0.0.1:8097")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := net.Dial("tcp", "127.0.0.1:8097")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Streams over the limit are closed as soon as they are accepted
+	second.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, err = second.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Error(errors.New("Stream over the host limit should be refused"))
+	}
+	first.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err = first.Read(make([]byte, 1))
+	if err == io.EOF {
+		t.Error(errors.New("Stream within the host limit should stay open"))
+	}
+	//Closing a stream frees its place
+	first.Close()
+	time.Sleep(time.Millisecond * 100)
+	third, err := net.Dial("tcp", "127.0.0.1:8097")
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err = third.Read(make([]byte, 1))
+	if err == io.EOF {
+		t.Error(errors.New("Closed stream should free its place"))
+	}
+	second.Close()
+	third.Close()
+	T.Close()
+}
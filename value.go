@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sort"
+)
+
+// Security event counted when a value's signature does not check out
+const SecurityTampered = "tampered"
+
+// signedValue is what a value's author signs. Fields are sorted since gob
+// writes maps in no particular order, and the key is included so a signed
+// value can not be replayed under another key
+type signedValue struct {
+	Key                    string
+	Modified               int64
+	ConflictResolutionMode int
+	Author                 string
+	Fields                 []valueField
+	Sealed                 *SealedValue
+}
+
+type valueField struct {
+	Name  string
+	Value interface{}
+}
+
+func valueBytes(Key string, v *Value) ([]byte, error) {
+	signed := signedValue{Key: Key, Modified: v.Modified, ConflictResolutionMode: v.ConflictResolutionMode, Author: v.Author, Sealed: v.Sealed}
+	for name, field := range v.Value {
+		signed.Fields = append(signed.Fields, valueField{Name: name, Value: field})
+	}
+	sort.Slice(signed.Fields, func(i, j int) bool {
+		return signed.Fields[i].Name < signed.Fields[j].Name
+	})
+	valueBytes := bytes.Buffer{}
+	err := gob.NewEncoder(&valueBytes).Encode(signed)
+	return valueBytes.Bytes(), err
+}
+
+// SignValue makes the local peer the value's author and signs it with the
+// local identity key
+func (c *Cluster) SignValue(Key string, v *Value) error {
+	v.Author = c.LocalPeer.ID
+	v.AuthorKey = c.LocalPeer.PublicKey
+	v.AuthorCertificate = c.Certificate
+	data, err := valueBytes(Key, v)
+	if err != nil {
+		return err
+	}
+	v.Signature, err = c.Suite.Sign(c.LocalPeer.identity, data)
+	return err
+}
+
+// VerifyValue checks a value was signed by its author, whichever peer relayed
+// it. The author's key must be vouched for by the author's certificate or by
+// the author having been a peer, so a relay can not sign for itself with a
+// key of its own
+func (c *Cluster) VerifyValue(Key string, v *Value) error {
+	author, err := c.valueAuthor(v)
+	if err != nil {
+		return err
+	}
+	return c.verifyValueBy(Key, v, author)
+}
+
+func (c *Cluster) verifyValueBy(Key string, v *Value, Author *Peer) error {
+	if !bytes.Equal(Author.PublicKey, v.AuthorKey) {
+		return errors.New("Value is signed with a key the author does not use")
+	}
+	data, err := valueBytes(Key, v)
+	if err != nil {
+		return err
+	}
+	return c.Suite.Verify(v.AuthorKey, data, v.Signature)
+}
+
+// errUnknownAuthor is returned for a value whose author this peer has no
+// record of. That is not evidence of tampering, the author may have left
+// before this peer joined
+var errUnknownAuthor = errors.New("Unknown author")
+
+// keyRetained reports whether an ID is already bound to a key other than the
+// one given by a peer that is or was a member. A certificate can rebind an
+// ID, so only clusters without a CA hold to the first key. PeersMutex must
+// be held
+func (c *Cluster) keyRetained(ID string, PublicKey []byte) bool {
+	retained, ok := c.AuthorKeys[ID]
+	return c.CA == nil && ok && !bytes.Equal(retained, PublicKey)
+}
+
+// valueAuthor finds the author of a value along with its roles: a current
+// peer, the certificate carried with the value, or the key kept from when
+// the author was a peer
+func (c *Cluster) valueAuthor(v *Value) (*Peer, error) {
+	c.PeersMutex.RLock()
+	peer := c.Peers[v.Author]
+	retained := c.AuthorKeys[v.Author]
+	c.PeersMutex.RUnlock()
+	if peer != nil {
+		author := *peer
+		return &author, nil
+	}
+	if c.CA != nil {
+		if len(v.AuthorCertificate) == 0 {
+			return nil, errUnknownAuthor
+		}
+		author := &Peer{ID: v.Author, PublicKey: v.AuthorKey, Certificate: v.AuthorCertificate}
+		return author, c.AdmitPeer(author)
+	}
+	if retained == nil {
+		return nil, errUnknownAuthor
+	}
+	return &Peer{ID: v.Author, PublicKey: retained}, nil
+}
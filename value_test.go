@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSignedValues(t *testing.T) {
+	RSA := RSAUtil{}
+	RSA.InitializeReader()
+	RSA.SetKeyLength(1024)
+	RSA.GenerateKey()
+	S := NewSimulator(1, RSA.Key, FaultConfig{})
+	for i := 0; i < 3; i++ {
+		S.AddNode()
+	}
+	S.Run(time.Second * 2)
+	author, relay, C := S.Clusters[0], S.Clusters[1], S.Clusters[2]
+
+	err := author.SetValue("key", map[string]interface{}{"a": "b"}, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	S.Run(time.Second * 5)
+	if C.Values["key"] == nil || C.Values["key"].Author != author.LocalPeer.ID {
+		t.Fatal(errors.New("Signed value did not spread"))
+	}
+	if C.VerifyValue("key", C.Values["key"]) != nil {
+		t.Error(errors.New("Value should verify on every peer"))
+	}
+
+	//A relay changing the contents invalidates the author's signature
+	tampered := *relay.Values["key"]
+	tampered.Value = map[string]interface{}{"a": "evil"}
+	tampered.Modified++
+	if C.VerifyValue("key", &tampered) == nil {
+		t.Error(errors.New("Tampered value should not verify"))
+	}
+	//A value can not be moved to another key
+	if C.VerifyValue("other", C.Values["key"]) == nil {
+		t.Error(errors.New("Value should only verify under its own key"))
+	}
+	//Nor can the relay sign in the author's name with its own key
+	forged := &Value{Modified: S.Clock.Now().UnixNano(), Value: map[string]interface{}{"a": "forged"}}
+	relay.SignValue("key", forged)
+	forged.Author = author.LocalPeer.ID
+	if C.VerifyValue("key", forged) == nil {
+		t.Error(errors.New("Value signed with another peer's key should not verify"))
+	}
+
+	relay.ValuesMutex.Lock()
+	relay.Values["key"] = &tampered
+	relay.ValuesMutex.Unlock()
+	S.Run(time.Second * 5)
+	if author.Values["key"].Value["a"] != "b" || C.Values["key"].Value["a"] != "b" {
+		t.Error(errors.New("Tampered value was accepted"))
+	}
+	if C.SecurityEventCounts()[SecurityTampered] == 0 && author.SecurityEventCounts()[SecurityTampered] == 0 {
+		t.Error(errors.New("Tampered value was not counted"))
+	}
+	//The relay may know the author by another key, so it is not blamed
+	if C.Score(relay.LocalPeer.ID) != 0 || author.Score(relay.LocalPeer.ID) != 0 {
+		t.Error(errors.New("Relay should not be penalized for a value"))
+	}
+
+	//A value still verifies once its author has left
+	author.SetValue("other", map[string]interface{}{"a": "c"}, 0)
+	other := author.Values["other"]
+	C.PeersMutex.Lock()
+	C.removePeer(author.LocalPeer.ID)
+	C.PeersMutex.Unlock()
+	if C.VerifyValue("key", C.Values["key"]) != nil {
+		t.Error(errors.New("Value should verify after its author left"))
+	}
+	//An author this peer never knew is not taken for tampering
+	C.PeersMutex.Lock()
+	delete(C.AuthorKeys, author.LocalPeer.ID)
+	C.PeersMutex.Unlock()
+	events := C.SecurityEventCounts()[SecurityTampered]
+	if C.ParseNewValues(map[string]*Value{"other": other}) != nil || C.SecurityEventCounts()[SecurityTampered] != events {
+		t.Error(errors.New("Value from an unknown author should not count as tampered"))
+	}
+	if C.Values["other"] != nil {
+		t.Error(errors.New("Value from an unknown author should not be accepted"))
+	}
+	S.Shutdown()
+}